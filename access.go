@@ -0,0 +1,164 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"fmt"
+
+	"github.com/araddon/gou"
+	"github.com/tawawhite/go-socks5"
+)
+
+//Access modes, by which the blacklist and whitelist rules apply.
+const (
+	MODE_OPEN      = "open"      //every host is allowed
+	MODE_BLACKLIST = "blacklist" //blacklisted hosts are denied
+	MODE_WHITELIST = "whitelist" //only whitelisted hosts are allowed
+	MODE_COMBINED  = "combined"  //both lists apply, by precedence
+)
+
+//Precedences of the combined mode, for hosts in both lists or in neither.
+const (
+	//Deny wins: only whitelisted hosts that aren't blacklisted are allowed.
+	PRECEDENCE_DENY = "deny"
+	//Allow wins: whitelisted hosts are allowed, other blacklisted hosts are denied,
+	//and hosts in neither list are allowed.
+	PRECEDENCE_ALLOW = "allow"
+)
+
+//An AccessMode is which lists apply to the connections of a session, and which
+//one wins in the combined mode.
+type AccessMode struct {
+	Mode       string
+	Precedence string //of MODE_COMBINED, PRECEDENCE_DENY if empty
+}
+
+func accessMode(blacklist, whitelist bool, precedence string) AccessMode {
+	mode := AccessMode{Mode: MODE_OPEN}
+	switch {
+	case blacklist && whitelist:
+		mode.Mode = MODE_COMBINED
+	case blacklist:
+		mode.Mode = MODE_BLACKLIST
+	case whitelist:
+		mode.Mode = MODE_WHITELIST
+	}
+	if mode.Precedence = precedence; mode.Precedence == "" {
+		mode.Precedence = PRECEDENCE_DENY
+	}
+	return mode
+}
+
+//lists returns whether the blacklist and the whitelist apply in the mode, and its
+//precedence, or an error if either is unknown.
+func (m AccessMode) lists() (bool, bool, string, error) {
+	precedence := m.Precedence
+	switch precedence {
+	case "":
+		precedence = PRECEDENCE_DENY
+	case PRECEDENCE_DENY, PRECEDENCE_ALLOW:
+	default:
+		return false, false, "", fmt.Errorf("unknown precedence %q, expected deny or allow", m.Precedence)
+	}
+	switch m.Mode {
+	case MODE_OPEN:
+		return false, false, precedence, nil
+	case MODE_BLACKLIST:
+		return true, false, precedence, nil
+	case MODE_WHITELIST:
+		return false, true, precedence, nil
+	case MODE_COMBINED:
+		return true, true, precedence, nil
+	}
+	return false, false, "", fmt.Errorf("unknown access mode %q, expected open, blacklist, whitelist or combined", m.Mode)
+}
+
+//GetAccessMode returns the access mode of the package level sessions.
+func GetAccessMode() AccessMode {
+	accessSync.RLock()
+	defer accessSync.RUnlock()
+	return accessMode(Blacklist, Whitelist, Precedence)
+}
+
+//SetAccessMode switches the access mode of the package level sessions. Their
+//blacklist and whitelist rules are kept, and apply again when the mode uses them.
+func SetAccessMode(mode AccessMode) error {
+	blacklist, whitelist, precedence, err := mode.lists()
+	if err != nil {
+		return err
+	}
+	accessSync.Lock()
+	Blacklist, Whitelist, Precedence = blacklist, whitelist, precedence
+	accessSync.Unlock()
+	gou.Infof("Switched access mode. mode=%v; precedence=%v;", mode.Mode, precedence)
+	return nil
+}
+
+//AccessMode returns the access mode of the proxy.
+func (p *Proxy) AccessMode() AccessMode {
+	p.sync.Lock()
+	defer p.sync.Unlock()
+	return accessMode(p.options.Blacklist, p.options.Whitelist, p.options.Precedence)
+}
+
+//SetAccessMode switches the access mode of the proxy.
+func (p *Proxy) SetAccessMode(mode AccessMode) error {
+	blacklist, whitelist, precedence, err := mode.lists()
+	if err != nil {
+		return err
+	}
+	p.sync.Lock()
+	p.options.Blacklist, p.options.Whitelist, p.options.Precedence = blacklist, whitelist, precedence
+	p.sync.Unlock()
+	gou.Infof("Switched access mode of proxy %v. mode=%v; precedence=%v;", p.Name, mode.Mode, precedence)
+	return nil
+}
+
+//accessMode returns the access mode of the session, by the options of its Proxy or
+//else of the package level sessions.
+func (s *Session) accessMode() AccessMode {
+	if s.proxy != nil {
+		return s.proxy.AccessMode()
+	}
+	return GetAccessMode()
+}
+
+//access decides whether the session allows a connection to remote_addr, and why.
+//The reason is empty in the open mode.
+func (s *Session) access(remote_addr *socks5.AddrSpec) (bool, string) {
+	mode := s.accessMode()
+	switch mode.Mode {
+	case MODE_BLACKLIST:
+		if s.blacklisted(remote_addr) {
+			return false, "in blacklist"
+		}
+		return true, "not in blacklist"
+	case MODE_WHITELIST:
+		if !s.whitelisted(remote_addr) {
+			return false, "not in whitelist"
+		}
+		return true, "in whitelist"
+	case MODE_COMBINED:
+		if mode.Precedence == PRECEDENCE_ALLOW {
+			switch {
+			case s.whitelisted(remote_addr):
+				return true, "in whitelist"
+			case s.blacklisted(remote_addr):
+				return false, "in blacklist"
+			}
+			return true, "in neither list"
+		}
+		switch {
+		case s.blacklisted(remote_addr):
+			return false, "in blacklist"
+		case !s.whitelisted(remote_addr):
+			return false, "not in whitelist"
+		}
+		return true, "in whitelist"
+	}
+	return true, ""
+}
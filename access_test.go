@@ -0,0 +1,78 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAccessMode(t *testing.T) {
+	p := NewProxy(ProxyOptions{Name: "access", Addr: "localhost:0"})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	defer p.Close()
+	if mode := p.AccessMode(); mode.Mode != MODE_OPEN || mode.Precedence != PRECEDENCE_DENY {
+		t.Error("unexpected access mode", mode)
+	}
+	if err := p.SetAccessMode(AccessMode{Mode: "closed"}); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+	if err := p.SetAccessMode(AccessMode{Mode: MODE_COMBINED, Precedence: "first"}); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+
+	check := func(mode AccessMode, allowed bool) {
+		t.Helper()
+		if err := p.SetAccessMode(mode); err != nil {
+			t.Fatal("got error", err)
+		}
+		if _, err := ClientRequestThroughProxy(p.Addr(), nil); (err == nil) != allowed {
+			t.Errorf("expected allowed=%v in %v, got error %v", allowed, mode, err)
+		}
+	}
+	deny, allow := AccessMode{MODE_COMBINED, PRECEDENCE_DENY}, AccessMode{MODE_COMBINED, PRECEDENCE_ALLOW}
+
+	//in both lists
+	p.SetBlacklistForHost("localhost", true)
+	p.SetWhitelistForHost("localhost", true)
+	check(AccessMode{Mode: MODE_OPEN}, true)
+	check(AccessMode{Mode: MODE_BLACKLIST}, false)
+	check(AccessMode{Mode: MODE_WHITELIST}, true)
+	check(deny, false)
+	check(allow, true)
+
+	//in the blacklist only
+	p.SetWhitelistForHost("localhost", false)
+	check(deny, false)
+	check(allow, false)
+
+	//in neither list
+	p.SetBlacklistForHost("localhost", false)
+	check(deny, false)
+	check(allow, true)
+}
+
+func TestSetAccessMode(t *testing.T) {
+	defer SetAccessMode(AccessMode{Mode: MODE_OPEN})
+	if err := SetAccessMode(AccessMode{Mode: MODE_COMBINED, Precedence: PRECEDENCE_ALLOW}); err != nil {
+		t.Fatal("got error", err)
+	}
+	if !Blacklist || !Whitelist || GetAccessMode() != (AccessMode{MODE_COMBINED, PRECEDENCE_ALLOW}) {
+		t.Error("unexpected access mode", GetAccessMode())
+	}
+	if state := ExportState(); !state.Blacklist || !state.Whitelist || state.Precedence != PRECEDENCE_ALLOW {
+		t.Error("unexpected state", state)
+	}
+	if err := SetAccessMode(AccessMode{Mode: MODE_WHITELIST}); err != nil {
+		t.Fatal("got error", err)
+	}
+	if Blacklist || !Whitelist || GetAccessMode() != (AccessMode{MODE_WHITELIST, PRECEDENCE_DENY}) {
+		t.Error("unexpected access mode", GetAccessMode())
+	}
+}
@@ -0,0 +1,116 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/araddon/gou"
+	"github.com/tawawhite/go-socks5"
+)
+
+//bindTimeout is how long a BIND request waits for the remote to connect.
+var bindTimeout = 2 * time.Minute
+
+//bind serves a BIND request, e.g. for the data connection of an active mode FTP
+//server. The proxy listens on a new port, replies with it, and relays the first
+//connection from the host of the request like a CONNECT, after a second reply with
+//the address of the remote. The port of the request is ignored, as the remote
+//connects from a port of its own, and an unspecified address accepts any host.
+func (srv *server) bind(local net.Conn, req *request, rid string) {
+	remote_addr := req.addr
+	session := sessionForConn(srv.session, req.username, local.RemoteAddr())
+	anyHost := remote_addr.FQDN == "" && remote_addr.IP.IsUnspecified()
+	if !anyHost {
+		if err := resolve(remote_addr); err != nil {
+			gou.Error(err)
+			req.reply(REPLY_HOST_UNREACHABLE, nil)
+			local.Close()
+			return
+		}
+		if !admit(session, local, req, remote_addr, rid) {
+			return
+		}
+	}
+
+	addr := &net.TCPAddr{}
+	if tcp, ok := local.LocalAddr().(*net.TCPAddr); ok {
+		addr.IP = tcp.IP
+	}
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		gou.Error(err)
+		req.reply(REPLY_GENERAL_FAILURE, nil)
+		local.Close()
+		return
+	}
+	if err := req.reply(REPLY_SUCCEEDED, l.Addr()); err != nil {
+		gou.Error(err)
+		l.Close()
+		local.Close()
+		return
+	}
+	gou.Infof("Listening for bind. Bind=%v; Address=%v; rid=%v; session=%v;", l.Addr(), *remote_addr, rid, session.Name)
+
+	remote, err := srv.accept(l, remote_addr, anyHost)
+	if err != nil {
+		gou.Error(err)
+		req.reply(dialReply(err), nil)
+		local.Close()
+		return
+	}
+	peer := remote.RemoteAddr().(*net.TCPAddr)
+	if anyHost {
+		remote_addr = &socks5.AddrSpec{IP: peer.IP, Port: peer.Port}
+		if !admit(session, local, req, remote_addr, rid) {
+			remote.Close()
+			return
+		}
+	}
+	if !srv.track(remote, false) {
+		local.Close()
+		return
+	}
+	defer srv.untrack(remote)
+	if err := req.reply(REPLY_SUCCEEDED, peer); err != nil {
+		gou.Error(err)
+		local.Close()
+		remote.Close()
+		return
+	}
+	gou.Infof("New bind connection. Address=%v; Remote=%v; rid=%v; session=%v;", *remote_addr, peer, rid, session.Name)
+	srv.pipe(session, local, remote, remote_addr, rid)
+}
+
+//accept accepts the first connection on l from the ip of remote_addr, or from any
+//host, within bindTimeout, and closes l.
+func (srv *server) accept(l *net.TCPListener, remote_addr *socks5.AddrSpec, anyHost bool) (net.Conn, error) {
+	defer l.Close()
+	accepted := make(chan struct{})
+	defer close(accepted)
+	go func() {
+		select {
+		case <-srv.done:
+			l.Close()
+		case <-accepted:
+		}
+	}()
+
+	l.SetDeadline(time.Now().Add(bindTimeout))
+	for {
+		remote, err := l.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		if anyHost || remote.RemoteAddr().(*net.TCPAddr).IP.Equal(remote_addr.IP) {
+			return remote, nil
+		}
+		gou.Infof("Refusing bind connection from another host. Remote=%v; Address=%v;", remote.RemoteAddr(), *remote_addr)
+		remote.Close()
+	}
+}
@@ -0,0 +1,100 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//readReply reads a SOCKS5 reply with an ipv4 address, and returns its code and
+//address.
+func readReply(t *testing.T, conn net.Conn) (byte, *net.TCPAddr) {
+	t.Helper()
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal("got error", err)
+	}
+	return reply[1], &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+}
+
+//socks5Bind sends a BIND request for the ipv4 address addr and returns the
+//connection and the first reply.
+func socks5Bind(t *testing.T, proxy string, addr *net.TCPAddr) (net.Conn, byte, *net.TCPAddr) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	request := []byte{socks5Version, 1, authNone, socks5Version, commandBind, 0, atypIPv4}
+	request = append(append(request, addr.IP.To4()...), byte(addr.Port>>8), byte(addr.Port))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal("got error", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal("got error", err)
+	}
+	code, bound := readReply(t, conn)
+	return conn, code, bound
+}
+
+func TestBind(t *testing.T) {
+	p := NewProxy(ProxyOptions{Name: "bind", Addr: "127.0.0.1:0"})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	defer p.Close()
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 21}
+
+	conn, code, bound := socks5Bind(t, p.Addr(), addr)
+	defer conn.Close()
+	if code != REPLY_SUCCEEDED {
+		t.Fatal("expected success, got", code)
+	}
+	remote, err := net.Dial("tcp", bound.String())
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer remote.Close()
+	code, peer := readReply(t, conn)
+	if code != REPLY_SUCCEEDED || peer.String() != remote.LocalAddr().String() {
+		t.Fatal("expected the address of the remote, got", code, peer)
+	}
+
+	//the accepted connection gets the rules of the requested host
+	p.AddRule(Rule{Type: PER_REMOTE_WRITE, Host: "127.0.0.1", LatencyAndCountStruct: LatencyAndCountStruct{Latency: 300 * time.Millisecond, Count: 1}})
+	remote.Write([]byte("220 data"))
+	data := make([]byte, 8)
+	if _, err := io.ReadFull(conn, data); err != nil || string(data) != "220 data" {
+		t.Error("unexpected data", string(data), err)
+	}
+	started := time.Now()
+	conn.Write([]byte("STOR"))
+	if _, err := io.ReadFull(remote, data[:4]); err != nil || string(data[:4]) != "STOR" {
+		t.Error("unexpected data", string(data[:4]), err)
+	}
+	if time.Since(started) < 300*time.Millisecond {
+		t.Error("expected the write latency to apply")
+	}
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	if p.Counters()["conns;"+addr.String()+";Total"] != 1 || p.Counters()["bytes;"+addr.String()+";Out"] != 4 || p.Counters()["bytes;"+addr.String()+";In"] != 8 {
+		t.Error("expected the connection to be counted", p.Counters())
+	}
+
+	//denied before listening
+	p.SetAccessMode(AccessMode{Mode: MODE_BLACKLIST})
+	p.SetBlacklistForHost("127.0.0.1", true)
+	conn, code, _ = socks5Bind(t, p.Addr(), addr)
+	conn.Close()
+	if code != REPLY_NOT_ALLOWED {
+		t.Error("expected the request to be denied, got", code)
+	}
+}
@@ -0,0 +1,398 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+//Package client is a Go client of the v2 admin API of the destructive proxy.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+//Rule types.
+const (
+	PER_REMOTE_WRITE   = "per_remote_write"
+	PER_REMOTE_READ    = "per_remote_read"
+	PER_REMOTE_CONNECT = "per_remote_connect"
+	PER_REMOTE_UDP     = "per_remote_udp"
+	BLACKLIST          = "blacklist"
+	WHITELIST          = "whitelist"
+)
+
+//NO_LIMIT is the Count of rules that apply any number of times.
+const NO_LIMIT = -1
+
+//Access modes, and precedences of the combined mode. See Access.
+const (
+	MODE_OPEN        = "open"
+	MODE_BLACKLIST   = "blacklist"
+	MODE_WHITELIST   = "whitelist"
+	MODE_COMBINED    = "combined"
+	PRECEDENCE_DENY  = "deny"
+	PRECEDENCE_ALLOW = "allow"
+)
+
+//Error codes of the admin API.
+const (
+	INVALID_REQUEST = "invalid_request"
+	NOT_FOUND       = "not_found"
+	CONFLICT        = "conflict"
+	UNAUTHORIZED    = "unauthorized"
+	FORBIDDEN       = "forbidden"
+	INTERNAL_ERROR  = "internal_error"
+)
+
+//An Error is an error returned by the admin API.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v (%v): %v", e.Code, e.Status, e.Message)
+}
+
+//IsNotFound reports whether err is a not_found error of the admin API.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == NOT_FOUND
+}
+
+//A Session owns a set of rules and counters. See the Sessions section of the README.
+type Session struct {
+	Name     string
+	Username string
+	Sources  []string
+	Addr     string
+	Created  time.Time
+}
+
+//A Ramp scales the latency and failure rate of a rule over time.
+type Ramp struct {
+	Up   time.Duration
+	Hold time.Duration
+	Down time.Duration
+}
+
+//A Rule is a fault. Type is one of the rule types, and Host a host name, an ip, a
+//cidr or * for any host. Count is the number of times the rule applies, NO_LIMIT
+//(< 0) for no limit, and 0 in rules returned by the proxy once used up, which the
+//proxy refuses to set. TTL is counted from Start
+//when setting a rule without Expires, and is the time left in rules returned by
+//the proxy, which also have the ip or cidr Host resolved to in Match.
+//PER_REMOTE_UDP rules delay datagrams by Latency, drop them at FailureRate, and
+//also have the datagram faults DuplicateRate, ReorderRate and Truncate.
+type Rule struct {
+	ID          string
+	Type        string
+	Host        string
+	Match       string
+	Priority    int
+	Latency     time.Duration
+	Count       int
+	FailureRate float64
+	Start       time.Time
+	Expires     time.Time
+	TTL         time.Duration
+	Ramp        *Ramp
+
+	DuplicateRate float64
+	ReorderRate   float64
+	Truncate      int
+}
+
+//A Connection is an active proxied connection.
+type Connection struct {
+	ID      string    `json:"id"`
+	Session string    `json:"session"`
+	Client  string    `json:"client"`
+	Remote  string    `json:"remote"`
+	Started time.Time `json:"started"`
+}
+
+//An Access is which of the blacklist and whitelist rules apply. In the combined
+//mode, the deny precedence only allows whitelisted hosts that aren't blacklisted,
+//and the allow precedence allows whitelisted hosts and hosts in neither list.
+type Access struct {
+	Mode       string `json:"mode"`
+	Precedence string `json:"precedence,omitempty"`
+}
+
+//A Client calls the admin API at BaseURL, e.g. http://localhost:4000, for the
+//rules, counters and connections of Session, or of the default session if empty.
+//Token is sent as a bearer token if set. Client certificates are set in the TLS
+//config of HTTPClient's transport.
+type Client struct {
+	BaseURL    string
+	Session    string
+	Token      string
+	HTTPClient *http.Client
+}
+
+//New returns a client of the admin API at baseURL, or listening on a unix socket
+//if baseURL is unix:/path/to/socket.
+func New(baseURL string) *Client {
+	c := &Client{BaseURL: baseURL, HTTPClient: &http.Client{Timeout: 30 * time.Second}}
+	if strings.HasPrefix(baseURL, "unix:") {
+		path := strings.TrimPrefix(baseURL, "unix:")
+		c.BaseURL = "http://unix"
+		c.HTTPClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}
+	}
+	return c
+}
+
+//Default is the client used by the package level helpers. Its BaseURL is
+//$DSP_ADMIN_URL, or http://localhost:4000 if unset, and its Token $DSP_ADMIN_TOKEN.
+var Default = defaultClient()
+
+func defaultClient() *Client {
+	c := New(defaultURL())
+	c.Token = os.Getenv("DSP_ADMIN_TOKEN")
+	return c
+}
+
+func defaultURL() string {
+	if u := os.Getenv("DSP_ADMIN_URL"); u != "" {
+		return u
+	}
+	return "http://localhost:4000"
+}
+
+//ForSession returns a copy of the client for the named session.
+func (c *Client) ForSession(name string) *Client {
+	other := *c
+	other.Session = name
+	return &other
+}
+
+func (c *Client) session() string {
+	if c.Session == "" {
+		return "default"
+	}
+	return c.Session
+}
+
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		var failure struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(data, &failure); err != nil || failure.Error.Code == "" {
+			return &Error{resp.StatusCode, http.StatusText(resp.StatusCode), string(data)}
+		}
+		return &Error{resp.StatusCode, failure.Error.Code, failure.Error.Message}
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (c *Client) sessionPath(suffix string) string {
+	return "/v2/sessions/" + url.PathEscape(c.session()) + suffix
+}
+
+//Sessions lists the sessions, including the default session.
+func (c *Client) Sessions() ([]Session, error) {
+	var sessions []wireSession
+	if err := c.do("GET", "/v2/sessions", nil, &sessions); err != nil {
+		return nil, err
+	}
+	result := []Session{}
+	for _, s := range sessions {
+		result = append(result, s.session())
+	}
+	return result, nil
+}
+
+//CreateSession creates a session.
+func (c *Client) CreateSession(s Session) (Session, error) {
+	var created wireSession
+	err := c.do("POST", "/v2/sessions", wireSession{s.Name, s.Username, s.Sources, s.Addr, nil}, &created)
+	return created.session(), err
+}
+
+//DeleteSession deletes the named session.
+func (c *Client) DeleteSession(name string) error {
+	return c.do("DELETE", "/v2/sessions/"+url.PathEscape(name), nil, nil)
+}
+
+//Rules lists the session's rules in evaluation order.
+func (c *Client) Rules() ([]Rule, error) {
+	var rules []wireRule
+	if err := c.do("GET", c.sessionPath("/rules"), nil, &rules); err != nil {
+		return nil, err
+	}
+	result := []Rule{}
+	for _, rule := range rules {
+		r, err := rule.rule()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+//GetRule returns the rule with the given id.
+func (c *Client) GetRule(id string) (Rule, error) {
+	var rule wireRule
+	if err := c.do("GET", c.sessionPath("/rules/"+url.PathEscape(id)), nil, &rule); err != nil {
+		return Rule{}, err
+	}
+	return rule.rule()
+}
+
+//SetRule sets rule, replacing a rule of the same type for the same host, and
+//returns it with its id.
+func (c *Client) SetRule(rule Rule) (Rule, error) {
+	var set wireRule
+	if err := c.do("POST", c.sessionPath("/rules"), toWire(rule), &set); err != nil {
+		return Rule{}, err
+	}
+	return set.rule()
+}
+
+//UpdateRule replaces the rule with the given id.
+func (c *Client) UpdateRule(id string, rule Rule) (Rule, error) {
+	var set wireRule
+	if err := c.do("PUT", c.sessionPath("/rules/"+url.PathEscape(id)), toWire(rule), &set); err != nil {
+		return Rule{}, err
+	}
+	return set.rule()
+}
+
+//DeleteRule removes the rule with the given id.
+func (c *Client) DeleteRule(id string) error {
+	return c.do("DELETE", c.sessionPath("/rules/"+url.PathEscape(id)), nil, nil)
+}
+
+//ClearRules removes all of the session's rules.
+func (c *Client) ClearRules() error {
+	rules, err := c.Rules()
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := c.DeleteRule(rule.ID); err != nil && !IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+//SetLatency sets the _type latency of host, applied count times, or with no limit
+//if count is NO_LIMIT.
+func (c *Client) SetLatency(host, _type string, latency time.Duration, count int) (Rule, error) {
+	return c.SetRule(Rule{Type: _type, Host: host, Latency: latency, Count: count})
+}
+
+//Blacklist adds host to the session's blacklist.
+func (c *Client) Blacklist(host string) (Rule, error) {
+	return c.SetRule(Rule{Type: BLACKLIST, Host: host, Count: NO_LIMIT})
+}
+
+//Whitelist adds host to the session's whitelist.
+func (c *Client) Whitelist(host string) (Rule, error) {
+	return c.SetRule(Rule{Type: WHITELIST, Host: host, Count: NO_LIMIT})
+}
+
+//Counters returns the session's counters.
+func (c *Client) Counters() (map[string]float64, error) {
+	counters := map[string]float64{}
+	err := c.do("GET", c.sessionPath("/counters"), nil, &counters)
+	return counters, err
+}
+
+//ResetCounters resets the session's counters.
+func (c *Client) ResetCounters() error {
+	return c.do("DELETE", c.sessionPath("/counters"), nil, nil)
+}
+
+//Connections lists the session's active connections, oldest first.
+func (c *Client) Connections() ([]Connection, error) {
+	conns := []Connection{}
+	err := c.do("GET", c.sessionPath("/connections"), nil, &conns)
+	return conns, err
+}
+
+//Access returns the access mode of the proxy, which applies to every session.
+func (c *Client) Access() (Access, error) {
+	var access Access
+	err := c.do("GET", "/v2/access", nil, &access)
+	return access, err
+}
+
+//SetAccess switches the access mode of the proxy. The precedence only applies to
+//the combined mode, deny if empty.
+func (c *Client) SetAccess(mode, precedence string) (Access, error) {
+	var access Access
+	err := c.do("PUT", "/v2/access", Access{mode, precedence}, &access)
+	return access, err
+}
+
+//ExportState returns the fault state of the proxy, in the format of its config file.
+func (c *Client) ExportState() (json.RawMessage, error) {
+	var state json.RawMessage
+	err := c.do("GET", "/state/export", nil, &state)
+	return state, err
+}
+
+//ImportState replaces the fault state of the proxy with state, in the format of
+//its config file.
+func (c *Client) ImportState(state json.RawMessage) error {
+	return c.do("POST", "/state/import", state, nil)
+}
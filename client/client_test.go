@@ -0,0 +1,176 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeAdmin serves the rules and counters endpoints of the default session.
+type fakeAdmin struct {
+	sync  sync.Mutex
+	rules map[string]wireRule
+	next  int
+}
+
+func (f *fakeAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.sync.Lock()
+	defer f.sync.Unlock()
+	fail := func(status int, code, message string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]map[string]string{"error": {"code": code, "message": message}})
+	}
+	const prefix = "/v2/sessions/default/rules"
+	switch {
+	case r.URL.Path == "/v2/sessions/default/counters":
+		json.NewEncoder(w).Encode(map[string]float64{"conns;Total:All": 2})
+	case r.URL.Path == prefix && r.Method == "GET":
+		rules := []wireRule{}
+		for _, rule := range f.rules {
+			rules = append(rules, rule)
+		}
+		json.NewEncoder(w).Encode(rules)
+	case r.URL.Path == prefix && r.Method == "POST":
+		var rule wireRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil || rule.Host == "" {
+			fail(400, INVALID_REQUEST, "host is required")
+			return
+		}
+		f.next++
+		rule.ID = strings.Repeat("r", f.next)
+		f.rules[rule.ID] = rule
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(rule)
+	case strings.HasPrefix(r.URL.Path, prefix+"/"):
+		id := strings.TrimPrefix(r.URL.Path, prefix+"/")
+		rule, ok := f.rules[id]
+		if !ok {
+			fail(404, NOT_FOUND, "no rule "+id)
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(f.rules, id)
+			w.WriteHeader(204)
+			return
+		}
+		json.NewEncoder(w).Encode(rule)
+	default:
+		fail(404, NOT_FOUND, r.URL.Path)
+	}
+}
+
+func TestClient(t *testing.T) {
+	admin := &fakeAdmin{rules: map[string]wireRule{}}
+	srv := httptest.NewServer(admin)
+	defer srv.Close()
+	c := New(srv.URL)
+
+	rule, err := c.SetRule(Rule{Type: PER_REMOTE_WRITE, Host: "db", Latency: 200 * time.Millisecond, Count: 5, Ramp: &Ramp{Up: time.Second, Down: time.Second}})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	got, err := c.GetRule(rule.ID)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if got.Latency != 200*time.Millisecond || got.Count != 5 || got.Ramp.Up != time.Second || got.Ramp.Down != time.Second {
+		t.Error("unexpected rule", got)
+	}
+
+	_, err = c.SetRule(Rule{Type: BLACKLIST})
+	if e, ok := err.(*Error); !ok || e.Status != 400 || e.Code != INVALID_REQUEST {
+		t.Error("expected an invalid_request error, got", err)
+	}
+	if err := c.DeleteRule("missing"); !IsNotFound(err) {
+		t.Error("expected a not_found error, got", err)
+	}
+
+	counters, err := c.Counters()
+	if err != nil || counters["conns;Total:All"] != 2 {
+		t.Error("unexpected counters", counters, err)
+	}
+
+	if err := c.ClearRules(); err != nil {
+		t.Fatal("got error", err)
+	}
+	if rules, _ := c.Rules(); len(rules) != 0 {
+		t.Error("expected no rules, got", rules)
+	}
+}
+
+func TestWithLatency(t *testing.T) {
+	admin := &fakeAdmin{rules: map[string]wireRule{}}
+	srv := httptest.NewServer(admin)
+	defer srv.Close()
+	c := New(srv.URL)
+
+	t.Run("latency", func(t *testing.T) {
+		rule := c.WithLatency(t, "db", 200*time.Millisecond)
+		if rule.Type != PER_REMOTE_WRITE || rule.Count != NO_LIMIT {
+			t.Error("unexpected rule", rule)
+		}
+		if rules, _ := c.Rules(); len(rules) != 1 {
+			t.Error("expected one rule, got", rules)
+		}
+	})
+	if rules, _ := c.Rules(); len(rules) != 0 {
+		t.Error("expected the rule to be removed, got", rules)
+	}
+}
+
+func TestClientToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(401)
+			json.NewEncoder(w).Encode(map[string]map[string]string{"error": {"code": UNAUTHORIZED, "message": "a valid bearer token is required"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]float64{})
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	if _, err := c.Counters(); err == nil || err.(*Error).Code != UNAUTHORIZED {
+		t.Error("expected an unauthorized error, got", err)
+	}
+	c.Token = "secret"
+	if _, err := c.Counters(); err != nil {
+		t.Error("got error", err)
+	}
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admin.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	srv := httptest.NewUnstartedServer(&fakeAdmin{rules: map[string]wireRule{}})
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	counters, err := New("unix:" + path).Counters()
+	if err != nil || counters["conns;Total:All"] != 2 {
+		t.Error("unexpected counters", counters, err)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package client
+
+import (
+	"time"
+)
+
+//TB is the part of testing.TB used by the test helpers.
+type TB interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+	Cleanup(func())
+}
+
+//WithRule sets rule for the rest of the test, and removes it when the test and
+//its subtests are done. The test fails if the rule can't be set.
+func (c *Client) WithRule(t TB, rule Rule) Rule {
+	t.Helper()
+	set, err := c.SetRule(rule)
+	if err != nil {
+		t.Fatalf("setting %v rule for %v: %v", rule.Type, rule.Host, err)
+	}
+	t.Cleanup(func() {
+		if err := c.DeleteRule(set.ID); err != nil && !IsNotFound(err) {
+			t.Fatalf("removing %v rule for %v: %v", set.Type, set.Host, err)
+		}
+	})
+	return set
+}
+
+//WithLatency adds latency to every write to host for the rest of the test.
+func (c *Client) WithLatency(t TB, host string, latency time.Duration) Rule {
+	t.Helper()
+	return c.WithRule(t, Rule{Type: PER_REMOTE_WRITE, Host: host, Latency: latency, Count: NO_LIMIT})
+}
+
+//WithBlacklist blacklists host for the rest of the test.
+func (c *Client) WithBlacklist(t TB, host string) Rule {
+	t.Helper()
+	return c.WithRule(t, Rule{Type: BLACKLIST, Host: host, Count: NO_LIMIT})
+}
+
+//WithRule sets rule with the Default client for the rest of the test.
+func WithRule(t TB, rule Rule) Rule {
+	t.Helper()
+	return Default.WithRule(t, rule)
+}
+
+//WithLatency adds latency to every write to host with the Default client for the
+//rest of the test, e.g.
+//
+//	client.WithLatency(t, "db", 200*time.Millisecond)
+func WithLatency(t TB, host string, latency time.Duration) Rule {
+	t.Helper()
+	return Default.WithLatency(t, host, latency)
+}
+
+//WithBlacklist blacklists host with the Default client for the rest of the test.
+func WithBlacklist(t TB, host string) Rule {
+	t.Helper()
+	return Default.WithBlacklist(t, host)
+}
@@ -0,0 +1,118 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package client
+
+import (
+	"time"
+)
+
+//The json schemas of the admin API, see /v2/openapi.json.
+
+type wireSession struct {
+	Name     string     `json:"name"`
+	Username string     `json:"username,omitempty"`
+	Sources  []string   `json:"sources,omitempty"`
+	Addr     string     `json:"addr,omitempty"`
+	Created  *time.Time `json:"created,omitempty"`
+}
+
+func (s wireSession) session() Session {
+	session := Session{Name: s.Name, Username: s.Username, Sources: s.Sources, Addr: s.Addr}
+	if s.Created != nil {
+		session.Created = *s.Created
+	}
+	return session
+}
+
+type wireRamp struct {
+	Up   string `json:"up"`
+	Hold string `json:"hold,omitempty"`
+	Down string `json:"down,omitempty"`
+}
+
+type wireRule struct {
+	ID          string     `json:"id,omitempty"`
+	Type        string     `json:"type"`
+	Host        string     `json:"host"`
+	Match       string     `json:"match,omitempty"`
+	Priority    int        `json:"priority,omitempty"`
+	Latency     string     `json:"latency,omitempty"`
+	Count       *int       `json:"count,omitempty"`
+	FailureRate float64    `json:"failure_rate,omitempty"`
+	Start       *time.Time `json:"start,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	TTL         string     `json:"ttl,omitempty"`
+	Ramp        *wireRamp  `json:"ramp,omitempty"`
+
+	DuplicateRate float64 `json:"duplicate_rate,omitempty"`
+	ReorderRate   float64 `json:"reorder_rate,omitempty"`
+	Truncate      int     `json:"truncate,omitempty"`
+}
+
+func toWire(rule Rule) wireRule {
+	w := wireRule{Type: rule.Type, Host: rule.Host, Priority: rule.Priority, FailureRate: rule.FailureRate,
+		DuplicateRate: rule.DuplicateRate, ReorderRate: rule.ReorderRate, Truncate: rule.Truncate}
+	if rule.Latency > 0 {
+		w.Latency = rule.Latency.String()
+	}
+	w.Count = &rule.Count //explicit, so that a used up rule isn't set again with no limit
+	if !rule.Start.IsZero() {
+		w.Start = &rule.Start
+	}
+	//rules returned by the proxy have both, and expires is exact
+	if !rule.Expires.IsZero() {
+		w.Expires = &rule.Expires
+	} else if rule.TTL > 0 {
+		w.TTL = rule.TTL.String()
+	}
+	if rule.Ramp != nil {
+		w.Ramp = &wireRamp{rule.Ramp.Up.String(), rule.Ramp.Hold.String(), rule.Ramp.Down.String()}
+	}
+	return w
+}
+
+func (w wireRule) rule() (Rule, error) {
+	rule := Rule{ID: w.ID, Type: w.Type, Host: w.Host, Match: w.Match, Priority: w.Priority, FailureRate: w.FailureRate,
+		DuplicateRate: w.DuplicateRate, ReorderRate: w.ReorderRate, Truncate: w.Truncate}
+	rule.Count = NO_LIMIT
+	if w.Count != nil && *w.Count >= 0 {
+		rule.Count = *w.Count
+	}
+	if w.Start != nil {
+		rule.Start = *w.Start
+	}
+	if w.Expires != nil {
+		rule.Expires = *w.Expires
+	}
+	for _, field := range []struct {
+		s string
+		d *time.Duration
+	}{{w.Latency, &rule.Latency}, {w.TTL, &rule.TTL}} {
+		if err := parseDuration(field.s, field.d); err != nil {
+			return Rule{}, err
+		}
+	}
+	if w.Ramp != nil {
+		rule.Ramp = &Ramp{}
+		for _, field := range []struct {
+			s string
+			d *time.Duration
+		}{{w.Ramp.Up, &rule.Ramp.Up}, {w.Ramp.Hold, &rule.Ramp.Hold}, {w.Ramp.Down, &rule.Ramp.Down}} {
+			if err := parseDuration(field.s, field.d); err != nil {
+				return Rule{}, err
+			}
+		}
+	}
+	return rule, nil
+}
+
+func parseDuration(s string, d *time.Duration) (err error) {
+	if s != "" {
+		*d, err = time.ParseDuration(s)
+	}
+	return err
+}
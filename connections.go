@@ -0,0 +1,50 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"sort"
+	"time"
+)
+
+//A Connection is an active proxied connection of a session.
+type Connection struct {
+	ID      string
+	Session string
+	Client  string //address of the client
+	Remote  string //host:port requested by the client
+	Started time.Time
+}
+
+func (s *Session) addConnection(conn Connection) {
+	s.sync.Lock()
+	if s.conns == nil {
+		s.conns = make(map[string]Connection)
+	}
+	s.conns[conn.ID] = conn
+	s.sync.Unlock()
+}
+
+func (s *Session) removeConnection(id string) {
+	s.sync.Lock()
+	delete(s.conns, id)
+	s.sync.Unlock()
+}
+
+//Connections returns the session's active connections, oldest first.
+func (s *Session) Connections() []Connection {
+	conns := []Connection{}
+	s.sync.RLock()
+	for _, conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.sync.RUnlock()
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Started.Before(conns[j].Started)
+	})
+	return conns
+}
@@ -0,0 +1,41 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConnections(t *testing.T) {
+	p := NewProxy(ProxyOptions{Addr: "localhost:0"})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	defer p.Close()
+	p.SetLatencyForHost("localhost", PER_REMOTE_CONNECT, 500*time.Millisecond, 1)
+	done := make(chan error)
+	go func() {
+		_, err := ClientRequestThroughProxy(p.Addr(), nil)
+		done <- err
+	}()
+	time.Sleep(200e6)
+	conns := p.Connections()
+	if len(conns) != 1 || conns[0].Session != p.Name || conns[0].Remote == "" {
+		t.Error("expected one active connection, got", conns)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("got error", err)
+	}
+	for i := 0; i < 20 && len(p.Connections()) > 0; i++ {
+		time.Sleep(100e6)
+	}
+	if conns := p.Connections(); len(conns) != 0 {
+		t.Error("expected no active connections, got", conns)
+	}
+}
@@ -7,10 +7,11 @@ Copyright (c) 2016 Intuit Inc.
 package destructive_socks5_proxy
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -62,382 +63,420 @@ func (c Counter) Add(v float64) {
 	// })
 }
 
-func init() {
-	gou.SetupLogging("debug")
-	gou.SetColorIfTerminal()
-}
-
 //core
 const (
-	PER_REMOTE_READ    = "per_remote_read"
-	PER_REMOTE_WRITE   = "per_remote_write"
-	PER_REMOTE_CONNECT = "per_remote_connect"
-	ACTIVE_CONNS       = "conns;Active:All"
-	TOTAL_CONNS        = "conns;Total;All"
-	TOTAL_BYTES_IN     = "bytes;Total;In"
-	TOTAL_BYTES_OUT    = "bytes;Total;Out"
+	PER_REMOTE_READ     = "per_remote_read"
+	PER_REMOTE_WRITE    = "per_remote_write"
+	PER_REMOTE_CONNECT  = "per_remote_connect"
+	PER_REMOTE_UDP      = "per_remote_udp"
+	ACTIVE_CONNS        = "conns;Active:All"
+	TOTAL_CONNS         = "conns;Total;All"
+	TOTAL_BYTES_IN      = "bytes;Total;In"
+	TOTAL_BYTES_OUT     = "bytes;Total;Out"
+	TOTAL_DATAGRAMS_IN  = "datagrams;Total;In"
+	TOTAL_DATAGRAMS_OUT = "datagrams;Total;Out"
 )
 
+//Start and Expires are optional. A rule has no effect before Start and removes
+//itself at Expires. FailureRate is the probability of closing the connection each
+//time the rule applies, or of dropping the datagram for udp rules. A Ramp scales
+//Latency and FailureRate over time.
 type LatencyAndCountStruct struct {
-	Latency time.Duration
-	Count   int
+	Latency     time.Duration
+	Count       int
+	Start       time.Time `json:",omitzero"`
+	Expires     time.Time `json:",omitzero"`
+	FailureRate float64   `json:",omitempty"`
+	Ramp        *Ramp     `json:",omitempty"`
+}
+
+//A Ramp raises the intensity of a rule linearly from 0 to 1 over Up, keeps it at 1
+//for Hold, then lowers it back to 0 over Down. Without Down, the intensity stays at 1.
+type Ramp struct {
+	Up   time.Duration
+	Hold time.Duration `json:",omitempty"`
+	Down time.Duration `json:",omitempty"`
+}
+
+//Intensity returns the intensity elapsed into the ramp.
+func (r Ramp) Intensity(elapsed time.Duration) float64 {
+	switch {
+	case elapsed < 0:
+		return 0
+	case elapsed < r.Up:
+		return float64(elapsed) / float64(r.Up)
+	case elapsed < r.Up+r.Hold || r.Down == 0:
+		return 1
+	case elapsed < r.Up+r.Hold+r.Down:
+		return 1 - float64(elapsed-r.Up-r.Hold)/float64(r.Down)
+	}
+	return 0
 }
 
-//Destructive behaviors
+//active reports whether the rule applies at now.
+func (l LatencyAndCountStruct) active(now time.Time) bool {
+	return !now.Before(l.Start) && (l.Expires.IsZero() || now.Before(l.Expires))
+}
+
+//At returns the latency and failure rate of the rule at now, scaled by its ramp.
+func (l LatencyAndCountStruct) At(now time.Time) (time.Duration, float64) {
+	if l.Ramp == nil {
+		return l.Latency, l.FailureRate
+	}
+	intensity := l.Ramp.Intensity(now.Sub(l.Start))
+	return time.Duration(float64(l.Latency) * intensity), l.FailureRate * intensity
+}
+
+//intensity returns the intensity of the rule's ramp at now, 1 without a ramp.
+func (l LatencyAndCountStruct) intensity(now time.Time) float64 {
+	if l.Ramp == nil {
+		return 1
+	}
+	return l.Ramp.Intensity(now.Sub(l.Start))
+}
+
+//TTL returns the time left until the rule expires, or -1 if it doesn't expire.
+func (l LatencyAndCountStruct) TTL() time.Duration {
+	if l.Expires.IsZero() {
+		return -1
+	}
+	if ttl := l.Expires.Sub(time.Now()); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+//Destructive behaviors. Blacklist and whitelist rules only apply while the list is
+//enabled. These enable them for the package level sessions, with the precedence of
+//the combined mode when both are; a Proxy has its own options. Use SetAccessMode to
+//switch them while serving.
 var (
-	HostToSleepPerRemoteWrite       = make(map[string]LatencyAndCountStruct)
-	HostToSleepPerRemoteWriteSync   sync.RWMutex
-	HostToSleepPerRemoteRead        = make(map[string]LatencyAndCountStruct)
-	HostToSleepPerRemoteReadSync    sync.RWMutex
-	HostToSleepPerRemoteConnect     = make(map[string]LatencyAndCountStruct)
-	HostToSleepPerRemoteConnectSync sync.RWMutex
-	Blacklist                       = false
-	HostToClose                     = make(map[string]interface{})
-	hostToCloseSync                 sync.RWMutex
-	Whitelist                       = false
-	HostToAllow                     = make(map[string]interface{})
-	hostToAllowSync                 sync.RWMutex
+	Blacklist  = false
+	Whitelist  = false
+	Precedence = PRECEDENCE_DENY
+	accessSync sync.RWMutex
 )
 
+//NewListenerForTcpCopyingProxy serves the package level sessions on addr, or as an
+//HTTP proxy on http://host:port (see listen). It blocks
+//until the listener fails to start or is stopped by Shutdown. Use a Proxy to embed
+//an isolated proxy.
 func NewListenerForTcpCopyingProxy(addr string) {
-	l, err := net.Listen("tcp", addr)
+	srv, _, err := listen(addr, nil)
 	if err != nil {
 		gou.Error(err)
+		return
 	}
+	sharedServersSync.Lock()
+	sharedServers = append(sharedServers, srv)
+	sharedServersSync.Unlock()
+	srv.serve()
+}
+
+//A server accepts connections on a listener until it is closed, and tracks them
+//until they are done. Connections accepted on a listener dedicated to a session
+//are bound to that session.
+type server struct {
+	listener  net.Listener
+	session   *Session         //nil for shared listeners
+	protocol  string           //PROTOCOL_SOCKS, PROTOCOL_HTTP or PROTOCOL_FORWARD
+	forward   *socks5.AddrSpec //target of PROTOCOL_FORWARD
+	handlers  sync.WaitGroup
+	conns     map[net.Conn]struct{}
+	connsSync sync.Mutex
+	closed    bool
+	done      chan struct{} //closed by close
+}
+
+func newServer(l net.Listener, session *Session) *server {
+	return &server{listener: l, session: session, protocol: PROTOCOL_SOCKS, conns: make(map[net.Conn]struct{}), done: make(chan struct{})}
+}
+
+//serve accepts connections until the listener is closed.
+func (srv *server) serve() {
 	for {
-		local, err := l.Accept()
+		local, err := srv.listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			gou.Error(err)
 			continue
 		}
+		if !srv.track(local, true) {
+			continue
+		}
 		go func() {
-			rid := uniuri.NewLen(15)
-			remote, remote_addr, err := socks5.HandleProtocol(local)
-			if err != nil {
-				gou.Error(err)
-				return
-			}
-
-			gou.Infof("New connection. Address=%v; rid=%v;", *remote_addr, rid)
-
-			Counter(fmt.Sprintf("conns;%v;Total", remote_addr.HostAndPort())).Inc()
-			Counter(TOTAL_CONNS).Inc()
-
-			Counter(ACTIVE_CONNS).Inc()
-			defer Counter(ACTIVE_CONNS).Dec()
+			defer srv.handlers.Done()
+			defer srv.untrack(local)
+			srv.handleConnection(local)
+		}()
+	}
+}
 
-			//sleep if remote ip exists in hostToSleepPerRemoteConnect
-			RW_Locker(HostToSleepPerRemoteConnectSync, func() {
-				host := remote_addr.IP.String()
-				latencyAndCount, exists := HostToSleepPerRemoteConnect[host]
-				if !exists {
-					if ip, err := socks5.ResolveToIpCaching(remote_addr.FQDN); err == nil {
-						host = ip.String()
-						latencyAndCount, exists = HostToSleepPerRemoteConnect[host]
-					}
-				}
+//track registers conn so that close can close it, and a handler for it if handler
+//is set. It closes conn and returns false if the server is closed.
+func (srv *server) track(conn net.Conn, handler bool) bool {
+	srv.connsSync.Lock()
+	defer srv.connsSync.Unlock()
+	if srv.closed {
+		conn.Close()
+		return false
+	}
+	srv.conns[conn] = struct{}{}
+	if handler {
+		srv.handlers.Add(1)
+	}
+	return true
+}
 
-				sleep := time.Duration(0)
-				if exists && latencyAndCount.Latency > 0 && latencyAndCount.Count != 0 {
-					sleep = latencyAndCount.Latency
-					if latencyAndCount.Count >= 1 { //was explicitly set
-						HostToSleepPerRemoteConnect[host] = LatencyAndCountStruct{latencyAndCount.Latency, latencyAndCount.Count - 1}
-					}
-				} else if latencyAndCount.Count == 0 { //was explicitly set and reached zero. Remove from map
-					delete(HostToSleepPerRemoteConnect, host)
-				} // latencyAndCount.count < 0 => continue to add latency
-
-				if sleep > 0 {
-					time.Sleep(sleep)
-					gou.Infof("Slept per connect: %v; Address=%v; rid=%v;", sleep, *remote_addr, rid)
-					Counter(fmt.Sprintf("latencyPerRequest;%v;Total", remote_addr.HostAndPort())).Add(sleep.Seconds())
-				}
-			})
-
-			connDoneCh := make(chan interface{}, 2)
-
-			go func(dst net.Conn, src net.Conn) {
-				data := make([]byte, 32*1024)
-				for {
-					RW_Locker(HostToSleepPerRemoteReadSync, func() {
-						host := remote_addr.IP.String()
-						latencyAndCount, exists := HostToSleepPerRemoteRead[host]
-						gou.Infof("remote_addr %v", remote_addr)
-						if !exists {
-							if ip, err := socks5.ResolveToIpCaching(remote_addr.FQDN); err == nil {
-								host = ip.String()
-								latencyAndCount, exists = HostToSleepPerRemoteRead[host]
-							}
-						}
-
-						if !exists && remote_addr.ProxyHost != "" {
-							if ip, err := socks5.ResolveToIpCaching(remote_addr.ProxyHost); err == nil {
-								host = ip.String()
-								latencyAndCount, exists = HostToSleepPerRemoteRead[host]
-								//gou.Debugf("proxy ProxyHost=%v ip=%v latencyAndCount=%v exists=%v hostToSleepPerRemoteConnect=%v", remote_addr.ProxyHost, ip, latencyAndCount, exists, hostToSleepPerRemoteConnect)
-							}
-
-						}
-
-						//gou.Infof("Here %v %v %v %v %v %v", hostToSleepPerRemoteRead, host, latencyAndCount.latency, latencyAndCount.count, exists, remote_addr)
-
-						sleep := time.Duration(0)
-						if exists && latencyAndCount.Latency > 0 && latencyAndCount.Count != 0 {
-							sleep = latencyAndCount.Latency
-							if latencyAndCount.Count >= 1 {
-								gou.Infof("latencyAndCount.count > 1. %v", latencyAndCount.Count)
-								HostToSleepPerRemoteRead[host] = LatencyAndCountStruct{latencyAndCount.Latency, latencyAndCount.Count - 1}
-							} // latencyAndCount.count < 0 => continue to add latency
-						} else if latencyAndCount.Count == 0 {
-							delete(HostToSleepPerRemoteRead, host)
-						}
-
-						if sleep > 0 {
-							time.Sleep(sleep)
-							gou.Infof("Slept per remote read: %v; Address=%v; rid=%v;", sleep, *remote_addr, rid)
-							Counter(fmt.Sprintf("latencyPerRemoteRead;%v;Total", remote_addr.HostAndPort())).Add(sleep.Seconds())
-						}
-					})
-					n, err := src.Read(data)
-					if err != nil {
-						if err != io.EOF {
-							gou.Error(err)
-						}
-						break
-					}
-
-					gou.Error(string(bytes.SplitN(data, []byte("\n"), 2)[0]))
-					if bytes.HasPrefix(data, []byte("CONNECT")) {
-						splt := bytes.SplitN(data, []byte("\n"), 2)
-						splt = bytes.Split(splt[0], []byte(" "))
-						splt = bytes.Split(splt[1], []byte(":"))
-						remote_addr.ProxyHost = string(splt[0])
-					}
-
-					if Blacklist {
-						closed := false
-						RW_Locker(hostToCloseSync, func() {
-							_, fqdn_exists := HostToClose[remote_addr.IP.String()]
-							_, proxy_exists := HostToClose[remote_addr.ProxyHost]
-
-							if fqdn_exists || proxy_exists {
-								gou.Infof("Closing connection in blacklist. Address=%v; rid=%v;", *remote_addr, rid)
-								Counter(fmt.Sprintf("closed;%v;Total", remote_addr.HostAndPort())).Inc()
-								local.Close()
-								remote.Close()
-								closed = true
-							} else {
-								gou.Infof("Allowing connection not in blacklist. Address=%v; rid=%v;", *remote_addr, rid)
-								Counter(fmt.Sprintf("allowed;%v;Total", remote_addr.HostAndPort())).Inc()
-							}
-						})
-						if closed {
-							break
-						}
-					}
-
-					if Whitelist {
-						closed := false
-						RW_Locker(hostToAllowSync, func() {
-							_, fqdn_exists := HostToAllow[remote_addr.IP.String()]
-							_, proxy_exists := HostToAllow[remote_addr.ProxyHost]
-
-							if !fqdn_exists || (remote_addr.ProxyHost != "" && !proxy_exists) {
-								gou.Infof("Closing connection not in whitelist. Address=%v; rid=%v;", *remote_addr, rid)
-								Counter(fmt.Sprintf("closed;%v;Total", remote_addr.HostAndPort())).Inc()
-								local.Close()
-								remote.Close()
-								closed = true
-							} else {
-								gou.Infof("Allowing connection in whitelist. Address=%v; rid=%v;", *remote_addr, rid)
-								Counter(fmt.Sprintf("allowed;%v;Total", remote_addr.HostAndPort())).Inc()
-							}
-						})
-						if closed {
-							break
-						}
-					}
-
-					RW_Locker(HostToSleepPerRemoteWriteSync, func() {
-						host := remote_addr.IP.String()
-						latencyAndCount, exists := HostToSleepPerRemoteWrite[host]
-						gou.Infof("remote_addr %v", remote_addr)
-						if !exists {
-							if ip, err := socks5.ResolveToIpCaching(remote_addr.FQDN); err == nil {
-								host = ip.String()
-								latencyAndCount, exists = HostToSleepPerRemoteWrite[host]
-							}
-						}
-
-						if !exists && remote_addr.ProxyHost != "" {
-							if ip, err := socks5.ResolveToIpCaching(remote_addr.ProxyHost); err == nil {
-								host = ip.String()
-								latencyAndCount, exists = HostToSleepPerRemoteWrite[host]
-								gou.Debugf("proxy ProxyHost=%v ip=%v latencyAndCount=%v exists=%v hostToSleepPerRemoteConnect=%v", remote_addr.ProxyHost, ip, latencyAndCount, exists, HostToSleepPerRemoteConnect)
-							}
-
-						}
-
-						//gou.Infof("Here %v %v %v %v %v %v", hostToSleepPerRemoteWrite, host, latencyAndCount.latency, latencyAndCount.count, exists, remote_addr)
-
-						sleep := time.Duration(0)
-						if exists && latencyAndCount.Latency > 0 && latencyAndCount.Count != 0 {
-							sleep = latencyAndCount.Latency
-							if latencyAndCount.Count >= 1 {
-								gou.Infof("latencyAndCount.count > 1. %v", latencyAndCount.Count)
-								HostToSleepPerRemoteWrite[host] = LatencyAndCountStruct{latencyAndCount.Latency, latencyAndCount.Count - 1}
-							} // latencyAndCount.count < 0 => continue to add latency
-						} else if latencyAndCount.Count == 0 {
-							delete(HostToSleepPerRemoteWrite, host)
-						}
-
-						if sleep > 0 {
-							time.Sleep(sleep)
-							gou.Infof("Slept per remote write: %v; Address=%v; rid=%v;", sleep, *remote_addr, rid)
-							Counter(fmt.Sprintf("latencyPerRemoteWrite;%v;Total", remote_addr.HostAndPort())).Add(sleep.Seconds())
-						}
-					})
-
-					Counter(TOTAL_BYTES_OUT).Add(float64(n))
-					Counter(fmt.Sprintf("bytes;%v;Out", remote_addr.HostAndPort())).Add(float64(n))
-					Counter(fmt.Sprintf("writes;%v;Out", remote_addr.HostAndPort())).Inc()
-					_, err = dst.Write(data[:n])
-					if err != nil {
-						gou.Error(err)
-						break
-					}
+func (srv *server) untrack(conn net.Conn) {
+	srv.connsSync.Lock()
+	delete(srv.conns, conn)
+	srv.connsSync.Unlock()
+}
 
-				}
+//close stops accepting connections, closes the tracked ones, interrupts their
+//latencies and waits for their handlers to return.
+func (srv *server) close() error {
+	err := srv.listener.Close()
+	srv.connsSync.Lock()
+	if !srv.closed {
+		srv.closed = true
+		close(srv.done)
+	}
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.connsSync.Unlock()
+	srv.handlers.Wait()
+	return err
+}
 
-				connDoneCh <- nil
+//A request is what a client asks the proxy for, in any of the protocols it serves.
+type request struct {
+	version  byte //of the socks protocol, 0 for HTTP
+	command  byte //commandConnect, commandBind, or commandUDPAssociate for SOCKS5
+	addr     *socks5.AddrSpec
+	username string   //picks the session, if set
+	conn     net.Conn //to relay instead of the accepted connection, e.g. to replay what was read ahead
+
+	//reply answers the request, in the protocol of the client, with a SOCKS5 reply
+	//code and the bound address.
+	reply func(code byte, bound net.Addr) error
+}
 
-			}(remote, local)
+//readRequest reads the request of a client in the protocol of the server: of an
+//HTTP proxy client, or of a SOCKS5 or SOCKS4/4a client, by the version in the
+//first byte. Forwarded connections request the target of the forward.
+func (srv *server) readRequest(conn net.Conn) (*request, error) {
+	switch srv.protocol {
+	case PROTOCOL_HTTP:
+		return readHTTPRequest(conn)
+	case PROTOCOL_FORWARD:
+		addr := *srv.forward
+		return &request{command: commandConnect, addr: &addr, reply: func(byte, net.Addr) error { return nil }}, nil
+	}
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return nil, err
+	}
+	switch version[0] {
+	case socks5Version:
+		return readSocks5Request(conn)
+	case socks4Version:
+		return readSocks4Request(conn)
+	}
+	return nil, fmt.Errorf("unsupported socks version %v", version[0])
+}
 
-			go func(dst net.Conn, src net.Conn) {
-				n, _ := io.Copy(dst, src) //Direct copy
-				Counter(TOTAL_BYTES_IN).Add(float64(n))
-				Counter(fmt.Sprintf("bytes;%v;In", remote_addr.HostAndPort())).Add(float64(n))
-				Counter(fmt.Sprintf("writes;%v;In", remote_addr.HostAndPort())).Inc()
-				connDoneCh <- nil
-			}(local, remote)
+func (srv *server) handleConnection(local net.Conn) {
+	rid := uniuri.NewLen(15)
+	req, err := srv.readRequest(local)
+	if err != nil {
+		gou.Error(err)
+		local.Close()
+		return
+	}
+	if req.conn != nil {
+		local = req.conn
+	}
+	remote_addr := req.addr
+	switch {
+	case req.command == commandUDPAssociate && req.version == socks5Version:
+		srv.associate(local, req, rid)
+		return
+	case req.command == commandBind:
+		srv.bind(local, req, rid)
+		return
+	case req.command != commandConnect:
+		gou.Errorf("Unsupported socks command %v. Address=%v; rid=%v;", req.command, *remote_addr, rid)
+		req.reply(REPLY_COMMAND_NOT_SUPPORTED, nil)
+		local.Close()
+		return
+	}
+	if err := resolve(remote_addr); err != nil {
+		gou.Error(err)
+		req.reply(REPLY_HOST_UNREACHABLE, nil)
+		local.Close()
+		return
+	}
 
-			//Wait for one of the connections to complete
-			<-connDoneCh
+	session := sessionForConn(srv.session, req.username, local.RemoteAddr())
+	//the access mode is applied before dialing, so denied hosts see no connection
+	if !admit(session, local, req, remote_addr, rid) {
+		return
+	}
 
-			time.Sleep(100e6) //allow any pending writes to complete
-			local.Close()
-			remote.Close()
-			gou.Debugf("Closed connections for Address=%v; rid=%v;", remote_addr, rid)
+	remote, err := net.Dial("tcp", net.JoinHostPort(remote_addr.IP.String(), strconv.Itoa(remote_addr.Port)))
+	if err != nil {
+		gou.Error(err)
+		req.reply(dialReply(err), nil)
+		local.Close()
+		return
+	}
+	if !srv.track(remote, false) {
+		local.Close()
+		return
+	}
+	defer srv.untrack(remote)
+	if err := req.reply(REPLY_SUCCEEDED, remote.LocalAddr()); err != nil {
+		gou.Error(err)
+		local.Close()
+		remote.Close()
+		return
+	}
+	gou.Infof("New connection. Address=%v; rid=%v; session=%v;", *remote_addr, rid, session.Name)
+	srv.pipe(session, local, remote, remote_addr, rid)
+}
 
-		}()
+//admit counts a connection of session to remote_addr, and applies the access mode
+//to it. A denied request is answered and closed.
+func admit(session *Session, local net.Conn, req *request, remote_addr *socks5.AddrSpec, rid string) bool {
+	session.Counter(fmt.Sprintf("conns;%v;Total", remote_addr.HostAndPort())).Inc()
+	session.Counter(TOTAL_CONNS).Inc()
+	if allowed, reason := session.access(remote_addr); !allowed {
+		gou.Infof("Denying connection %v. Address=%v; rid=%v; session=%v;", reason, *remote_addr, rid, session.Name)
+		session.Counter(fmt.Sprintf("closed;%v;Total", remote_addr.HostAndPort())).Inc()
+		req.reply(session.deniedReply(), nil)
+		local.Close()
+		return false
+	} else if reason != "" {
+		gou.Infof("Allowing connection %v. Address=%v; rid=%v; session=%v;", reason, *remote_addr, rid, session.Name)
+		session.Counter(fmt.Sprintf("allowed;%v;Total", remote_addr.HostAndPort())).Inc()
 	}
+	return true
 }
 
-func SetLatencyForHost(host, _type string, latency time.Duration, count int) (string, error) {
-	ip, err := socks5.ResolveToIpCaching(host)
+//pipe copies between local and remote, with the rules, middleware and counters of
+//session for remote_addr, until either side is done.
+func (srv *server) pipe(session *Session, local, remote net.Conn, remote_addr *socks5.AddrSpec, rid string) {
+	session.Counter(ACTIVE_CONNS).Inc()
+	defer session.Counter(ACTIVE_CONNS).Dec()
+	session.addConnection(Connection{rid, session.Name, local.RemoteAddr().String(), remote_addr.HostAndPort(), time.Now()})
+	defer session.removeConnection(rid)
+
+	//sleep if a per connect rule matches the remote
+	if session.applyLatency(PER_REMOTE_CONNECT, remote_addr, rid, srv.done) {
+		local.Close()
+		remote.Close()
+		return
+	}
+
+	chain, err := connectMiddleware(session.middlewares(), &ConnInfo{ID: rid, Session: session.Name, Client: local.RemoteAddr(), Remote: remote_addr})
 	if err != nil {
-		return "", err
+		session.Counter(fmt.Sprintf("closed;%v;Total", remote_addr.HostAndPort())).Inc()
+		local.Close()
+		remote.Close()
+		return
 	}
+	defer chain.close()
 
-	_resolved_ip := ip.String()
+	connDoneCh := make(chan interface{}, 2)
 
-	switch _type {
-	case PER_REMOTE_WRITE:
-		RW_Locker(HostToSleepPerRemoteWriteSync, func() {
-			if latency > 0 {
-				HostToSleepPerRemoteWrite[_resolved_ip] = LatencyAndCountStruct{latency, count}
-			} else {
-				delete(HostToSleepPerRemoteWrite, _resolved_ip)
-			}
-		})
-	case PER_REMOTE_READ:
-		RW_Locker(HostToSleepPerRemoteReadSync, func() {
-			if latency > 0 {
-				HostToSleepPerRemoteRead[_resolved_ip] = LatencyAndCountStruct{latency, count}
-			} else {
-				delete(HostToSleepPerRemoteRead, _resolved_ip)
+	go func(dst net.Conn, src net.Conn) {
+		data := make([]byte, 32*1024)
+		for {
+			if session.applyLatency(PER_REMOTE_READ, remote_addr, rid, srv.done) {
+				local.Close()
+				remote.Close()
+				break
 			}
-		})
-	case PER_REMOTE_CONNECT:
-		RW_Locker(HostToSleepPerRemoteConnectSync, func() {
-			if latency > 0 {
-				HostToSleepPerRemoteConnect[_resolved_ip] = LatencyAndCountStruct{latency, count}
-			} else {
-				delete(HostToSleepPerRemoteConnect, _resolved_ip)
+			n, err := src.Read(data)
+			if err != nil {
+				if err != io.EOF {
+					gou.Error(err)
+				}
+				break
 			}
-		})
-	}
 
-	gou.Infof("Set latency for %v (%v) to %v", host, ip, latency)
-	return ip.String(), nil
-}
+			if session.applyLatency(PER_REMOTE_WRITE, remote_addr, rid, srv.done) {
+				local.Close()
+				remote.Close()
+				break
+			}
 
-func SetBlacklistForHost(host string, add bool) (string, error) {
-	if !Blacklist {
-		return "", fmt.Errorf("Blacklist is not set")
-	}
-	ip, err := socks5.ResolveToIpCaching(host)
-	if err != nil {
-		return "", err
-	}
+			chunk, err := chain.chunk(OUTBOUND, data[:n])
+			if err != nil {
+				session.Counter(fmt.Sprintf("closed;%v;Total", remote_addr.HostAndPort())).Inc()
+				local.Close()
+				remote.Close()
+				break
+			}
 
-	_resolved_ip := ip.String()
+			session.Counter(TOTAL_BYTES_OUT).Add(float64(len(chunk)))
+			session.Counter(fmt.Sprintf("bytes;%v;Out", remote_addr.HostAndPort())).Add(float64(len(chunk)))
+			session.Counter(fmt.Sprintf("writes;%v;Out", remote_addr.HostAndPort())).Inc()
+			_, err = dst.Write(chunk)
+			if err != nil {
+				gou.Error(err)
+				break
+			}
 
-	RW_Locker(hostToCloseSync, func() {
-		if add {
-			HostToClose[_resolved_ip] = add
-		} else {
-			delete(HostToClose, _resolved_ip)
 		}
-	})
 
-	return ip.String(), nil
+		connDoneCh <- nil
+
+	}(remote, local)
+
+	go func(dst net.Conn, src net.Conn) {
+		n, err := chain.copy(dst, src, INBOUND)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			gou.Debugf("Closing connection on inbound copy. err=%v; Address=%v; rid=%v;", err, *remote_addr, rid)
+		}
+		session.Counter(TOTAL_BYTES_IN).Add(float64(n))
+		session.Counter(fmt.Sprintf("bytes;%v;In", remote_addr.HostAndPort())).Add(float64(n))
+		session.Counter(fmt.Sprintf("writes;%v;In", remote_addr.HostAndPort())).Inc()
+		connDoneCh <- nil
+	}(local, remote)
+
+	//Wait for one of the connections to complete
+	<-connDoneCh
+
+	time.Sleep(100e6) //allow any pending writes to complete
+	local.Close()
+	remote.Close()
+	gou.Debugf("Closed connections for Address=%v; rid=%v;", remote_addr, rid)
 }
 
-func SetWhitelistForHost(host string, add bool) (string, error) {
-	if !Whitelist {
-		return "", fmt.Errorf("Whitelist is not set")
-	}
+//The package level functions below operate on DefaultSession.
 
-	ip, err := socks5.ResolveToIpCaching(host)
-	if err != nil {
-		return "", err
-	}
+func SetLatencyForHost(host, _type string, latency time.Duration, count int) (string, error) {
+	return DefaultSession.SetLatencyForHost(host, _type, latency, count)
+}
 
-	_resolved_ip := ip.String()
+func SetLatencyRuleForHost(host, _type string, rule LatencyAndCountStruct) (string, error) {
+	return DefaultSession.SetLatencyRuleForHost(host, _type, rule)
+}
 
-	RW_Locker(hostToAllowSync, func() {
-		if add {
-			HostToAllow[_resolved_ip] = add
-		} else {
-			delete(HostToAllow, _resolved_ip)
-		}
-	})
+func SetBlacklistForHost(host string, add bool) (string, error) {
+	return DefaultSession.SetBlacklistForHost(host, add)
+}
 
-	return ip.String(), nil
+func SetWhitelistForHost(host string, add bool) (string, error) {
+	return DefaultSession.SetWhitelistForHost(host, add)
 }
 
 func GetLatencyForHost(host, _type string) (string, LatencyAndCountStruct, bool, error) {
-	ip, err := socks5.ResolveToIpCaching(host)
-	if err != nil {
-		return "", LatencyAndCountStruct{time.Duration(0), -1}, false, err
-	}
-	latencyAndCount, exists := LatencyAndCountStruct{time.Duration(0), -1}, false
-	switch _type {
-	case PER_REMOTE_WRITE:
-		RW_Locker(HostToSleepPerRemoteWriteSync, func() {
-			latencyAndCount, exists = HostToSleepPerRemoteWrite[ip.String()]
-		})
-	case PER_REMOTE_READ:
-		RW_Locker(HostToSleepPerRemoteReadSync, func() {
-			latencyAndCount, exists = HostToSleepPerRemoteRead[ip.String()]
-		})
-	case PER_REMOTE_CONNECT:
-		RW_Locker(HostToSleepPerRemoteConnectSync, func() {
-			latencyAndCount, exists = HostToSleepPerRemoteConnect[ip.String()]
-		})
-	}
-
-	gou.Infof("Got latency for %v (%v) to %v. Exists=%v.", host, ip, latencyAndCount, exists)
-	return ip.String(), latencyAndCount, exists, nil
+	return DefaultSession.GetLatencyForHost(host, _type)
 }
@@ -164,14 +164,15 @@ func TestLatencyRemoteConnect(t *testing.T) {
 }
 
 func TestBlacklist(t *testing.T) {
-	_, err := SetBlacklistForHost("localhost", true)
-	if err == nil {
-		t.Error("Expected an err but didn't get one")
+	if _, err := SetBlacklistForHost("localhost", true); err != nil {
+		t.Error("got error", err)
+	}
+	if _, err := SimpleClientRequest(); err != nil {
+		t.Error("expected the blacklist to be disabled, got error", err)
 	}
 	Blacklist = true
-	SetBlacklistForHost("localhost", true)
 
-	_, err = SimpleClientRequest()
+	_, err := SimpleClientRequest()
 	if err == nil {
 		t.Error("Expected an err but didn't get one")
 	}
@@ -186,15 +187,18 @@ func TestBlacklist(t *testing.T) {
 }
 
 func TestWhitelist(t *testing.T) {
-	_, err := SetWhitelistForHost("google.com", true)
-	if err == nil {
-		t.Error("Expected an err but didn't get one")
+	if _, err := SetWhitelistForHost("127.0.0.2", true); err != nil {
+		t.Error("got error", err)
 	}
+	if _, err := SimpleClientRequest(); err != nil {
+		t.Error("expected the whitelist to be disabled, got error", err)
+	}
+	defer SetWhitelistForHost("127.0.0.2", false)
 
 	Whitelist = true
 	SetWhitelistForHost("localhost", true)
-	fmt.Println(HostToAllow)
-	_, err = SimpleClientRequest()
+	fmt.Println(DefaultSession.ListRules())
+	_, err := SimpleClientRequest()
 	if err != nil {
 		t.Error("got error", err)
 	}
@@ -207,3 +211,41 @@ func TestWhitelist(t *testing.T) {
 
 	Whitelist = false
 }
+
+func TestRampIntensity(t *testing.T) {
+	ramp := Ramp{Up: 10e9, Hold: 5e9, Down: 10e9}
+	cases := map[time.Duration]float64{-1e9: 0, 0: 0, 5e9: 0.5, 10e9: 1, 12e9: 1, 20e9: 0.5, 25e9: 0, 30e9: 0}
+	for elapsed, expected := range cases {
+		if intensity := ramp.Intensity(elapsed); intensity != expected {
+			t.Error("unexpected intensity", elapsed, intensity, expected)
+		}
+	}
+	if intensity := (Ramp{Up: 10e9}).Intensity(time.Hour); intensity != 1 {
+		t.Error("expected a ramp without down to stay at 1", intensity)
+	}
+
+	start := time.Now()
+	rule := LatencyAndCountStruct{Latency: 2e9, FailureRate: 0.5, Start: start, Ramp: &Ramp{Up: 10e9}}
+	latency, failureRate := rule.At(start.Add(5e9))
+	if latency != 1e9 || failureRate != 0.25 {
+		t.Error("unexpected latency and failure rate halfway up the ramp", latency, failureRate)
+	}
+}
+
+func TestFailureRate(t *testing.T) {
+	_, err := SetLatencyRuleForHost("localhost", PER_REMOTE_CONNECT, LatencyAndCountStruct{Count: 1, FailureRate: 2})
+	if err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+
+	SetLatencyRuleForHost("localhost", PER_REMOTE_CONNECT, LatencyAndCountStruct{Count: 1, FailureRate: 1})
+	_, err = SimpleClientRequest()
+	if err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+
+	_, err = SimpleClientRequest()
+	if err != nil {
+		t.Error("got error", err)
+	}
+}
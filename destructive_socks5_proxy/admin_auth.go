@@ -0,0 +1,206 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+//Admin roles. The write role can also read.
+const (
+	ROLE_READ  = "read"
+	ROLE_WRITE = "write"
+)
+
+//An adminToken is a bearer token of the admin API.
+type adminToken struct {
+	Token string `json:"token"`
+	Role  string `json:"role"`
+	Name  string `json:"name,omitempty"` //identifies the caller, the role if empty
+}
+
+//adminAuth authenticates callers of the admin API with bearer tokens and/or client
+//certificates, and allows mutations to callers with the write role only.
+//Without tokens and a client CA every caller can read and write.
+type adminAuth struct {
+	tokens      []adminToken
+	clientCAs   *x509.CertPool
+	clientRoles map[string]string //role by certificate common name, * for any
+}
+
+//A caller of the admin API.
+type caller struct {
+	Name string //token name, certificate common name or remote address
+	Role string
+}
+
+type callerKey struct{}
+
+//callerOf returns the caller of an admin request.
+func callerOf(r *http.Request) caller {
+	if c, ok := r.Context().Value(callerKey{}).(caller); ok {
+		return c
+	}
+	return caller{r.RemoteAddr, ROLE_WRITE}
+}
+
+func validRole(role string) bool {
+	return role == ROLE_READ || role == ROLE_WRITE
+}
+
+func newAdminAuth(conf adminConfig) (*adminAuth, error) {
+	auth := &adminAuth{clientRoles: map[string]string{}}
+	for _, token := range conf.Tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("admin token of %v is empty", token.Name)
+		}
+		if !validRole(token.Role) {
+			return nil, fmt.Errorf("invalid role %q of admin token %v, expected read or write", token.Role, token.Name)
+		}
+		if token.Name == "" {
+			token.Name = token.Role
+		}
+		auth.tokens = append(auth.tokens, token)
+	}
+
+	if conf.ClientCA != "" {
+		pem, err := ioutil.ReadFile(conf.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		auth.clientCAs = x509.NewCertPool()
+		if !auth.clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %v", conf.ClientCA)
+		}
+		if conf.TLSCert == "" {
+			return nil, fmt.Errorf("the admin client CA requires an admin TLS certificate and key")
+		}
+	}
+	for name, role := range conf.ClientRoles {
+		if !validRole(role) {
+			return nil, fmt.Errorf("invalid role %q of client %v, expected read or write", role, name)
+		}
+		auth.clientRoles[name] = role
+	}
+	if len(auth.clientRoles) == 0 {
+		auth.clientRoles["*"] = ROLE_WRITE
+	}
+	return auth, nil
+}
+
+func (auth *adminAuth) enabled() bool {
+	return len(auth.tokens) > 0 || auth.clientCAs != nil
+}
+
+//tlsConfig requires a client certificate signed by the client CA, unless tokens
+//can be used instead.
+func (auth *adminAuth) tlsConfig() *tls.Config {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if auth.clientCAs != nil {
+		conf.ClientCAs = auth.clientCAs
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+		if len(auth.tokens) > 0 {
+			conf.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return conf
+}
+
+//authenticate returns the caller of r with the highest role among its token and
+//client certificate, false if neither is valid.
+func (auth *adminAuth) authenticate(r *http.Request) (caller, bool) {
+	found, ok := caller{}, false
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		presented := []byte(strings.TrimPrefix(header, "Bearer "))
+		for _, token := range auth.tokens {
+			if subtle.ConstantTimeCompare(presented, []byte(token.Token)) == 1 {
+				found, ok = caller{"token:" + token.Name, token.Role}, true
+				break
+			}
+		}
+	}
+	if auth.clientCAs != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		role, known := auth.clientRoles[cn]
+		if !known {
+			role, known = auth.clientRoles["*"]
+		}
+		if known && (!ok || role == ROLE_WRITE) {
+			found, ok = caller{"cert:" + cn, role}, true
+		}
+	}
+	return found, ok
+}
+
+//writeRoutes are the patterns of the v1 GET routes that change the state of the
+//proxy, registered with getWrite.
+var writeRoutes = map[string]bool{}
+
+//mutating reports whether r changes the state of the proxy. The v1 API mutates
+//with GETs, on the routes registered with getWrite.
+func mutating(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return true
+	}
+	for pattern := range writeRoutes {
+		if matchRoute(pattern, r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+//matchRoute reports whether path matches the route pattern, where a :param
+//matches any segment.
+func matchRoute(pattern, path string) bool {
+	segments, splt := strings.Split(pattern, "/"), strings.Split(strings.TrimRight(path, "/"), "/")
+	if len(segments) != len(splt) {
+		return false
+	}
+	for i, segment := range segments {
+		if segment != splt[i] && !strings.HasPrefix(segment, ":") {
+			return false
+		}
+	}
+	return true
+}
+
+func authError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	if status == 401 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]v2Error{"error": {code, message}})
+}
+
+//handler authorizes the requests to next, and records their caller for the audit log.
+func (auth *adminAuth) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := caller{r.RemoteAddr, ROLE_WRITE}
+		if auth.enabled() {
+			var ok bool
+			if c, ok = auth.authenticate(r); !ok {
+				authError(w, 401, "unauthorized", "a valid bearer token or client certificate is required")
+				return
+			}
+			if mutating(r) && c.Role != ROLE_WRITE {
+				authError(w, 403, "forbidden", fmt.Sprintf("%v has the %v role and can't change the proxy", c.Name, c.Role))
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, c)))
+	})
+}
@@ -0,0 +1,39 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Unknwon/macaron"
+)
+
+func TestMutating(t *testing.T) {
+	registerV1(macaron.New())
+	for target, expected := range map[string]bool{
+		"GET /session/create":                   false, //a session named create
+		"GET /session/create/create":            true,
+		"GET /session/ci/delete/":               true,
+		"GET /blacklisted":                      false,
+		"GET /blacklist/db/add":                 true,
+		"GET /set_latency/db/per_remote_write":  true,
+		"GET /get_latancy/db/per_remote_write":  false,
+		"GET /counters":                         false,
+		"GET /counters/reset":                   true,
+		"GET /scenario/start":                   false,
+		"GET /v2/sessions/default/rules":        false,
+		"POST /v2/sessions/default/rules":       true,
+		"DELETE /v2/sessions/default/rules/abc": true,
+	} {
+		splt := strings.SplitN(target, " ", 2)
+		if mutating(httptest.NewRequest(splt[0], splt[1], nil)) != expected {
+			t.Error("expected mutating to be", expected, "for", target)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+//Returns the address of the admin API, from the HOST and PORT env like macaron.
+func default_admin_addr() string {
+	host, port := os.Getenv("HOST"), os.Getenv("PORT")
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	if port == "" {
+		port = "4000"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+//Listens on the admin address, host:port or unix:/path/to/socket. A socket left
+//behind by a previous run is replaced, and the new one is only accessible to the
+//user running the proxy.
+func listen_admin(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+//Returns the url of the admin API listening on l.
+func admin_url(l net.Listener, tls bool) string {
+	if l.Addr().Network() == "unix" {
+		return "unix:" + l.Addr().String()
+	}
+	if tls {
+		return "https://" + l.Addr().String()
+	}
+	return "http://" + l.Addr().String()
+}
@@ -0,0 +1,567 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Unknwon/macaron"
+	dsp "github.com/intuit/destructive_socks5_proxy"
+)
+
+//The v2 admin API. Resources are json, mutations use POST, PUT and DELETE, and
+//failures return {"error": {"code": ..., "message": ...}} with a matching status.
+//The schemas are described by /v2/openapi.json.
+
+type v2Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type v2Session struct {
+	Name     string    `json:"name"`
+	Username string    `json:"username,omitempty"`
+	Sources  []string  `json:"sources,omitempty"`
+	Addr     string    `json:"addr,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+type v2Connection struct {
+	ID      string    `json:"id"`
+	Session string    `json:"session"`
+	Client  string    `json:"client"`
+	Remote  string    `json:"remote"`
+	Started time.Time `json:"started"`
+}
+
+type v2Ramp struct {
+	Up   string `json:"up"`
+	Hold string `json:"hold,omitempty"`
+	Down string `json:"down,omitempty"`
+}
+
+//Durations are duration strings (e.g., 100ms, 30s). In requests, ttl is counted
+//from start; in responses, it is the time left. Match, the ip or cidr host resolves
+//to, is only set in responses.
+type v2Rule struct {
+	ID          string     `json:"id,omitempty"`
+	Type        string     `json:"type"`
+	Host        string     `json:"host"`
+	Match       string     `json:"match,omitempty"`
+	Priority    int        `json:"priority,omitempty"`
+	Latency     string     `json:"latency,omitempty"`
+	Count       *int       `json:"count,omitempty"`
+	FailureRate float64    `json:"failure_rate,omitempty"`
+	Start       *time.Time `json:"start,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	TTL         string     `json:"ttl,omitempty"`
+	Ramp        *v2Ramp    `json:"ramp,omitempty"`
+
+	//datagram faults of per_remote_udp rules, whose failure rate is the drop rate
+	DuplicateRate float64 `json:"duplicate_rate,omitempty"`
+	ReorderRate   float64 `json:"reorder_rate,omitempty"`
+	Truncate      int     `json:"truncate,omitempty"`
+}
+
+//Schedules apply a rule during recurring windows. Next, the start of the next
+//window, is only set in responses.
+type v2Schedule struct {
+	Name     string     `json:"name"`
+	Host     string     `json:"host"`
+	Type     string     `json:"type"`
+	Latency  string     `json:"latency,omitempty"`
+	Count    *int       `json:"count,omitempty"`
+	Duration string     `json:"duration"`
+	Every    string     `json:"every,omitempty"`
+	Cron     string     `json:"cron,omitempty"`
+	Next     *time.Time `json:"next,omitempty"`
+}
+
+type v2ScenarioStep struct {
+	Action   string  `json:"action"`
+	Host     string  `json:"host,omitempty"`
+	Type     string  `json:"type,omitempty"`
+	Latency  string  `json:"latency,omitempty"`
+	Count    int     `json:"count,omitempty"`
+	Duration string  `json:"duration,omitempty"`
+	Counter  string  `json:"counter,omitempty"`
+	Op       string  `json:"op,omitempty"`
+	Value    float64 `json:"value,omitempty"`
+	Timeout  string  `json:"timeout,omitempty"`
+}
+
+//Scenarios are uploaded with a name, an optional session and steps. Their progress
+//is only set in responses.
+type v2Scenario struct {
+	Name     string           `json:"name"`
+	Session  string           `json:"session,omitempty"`
+	Steps    []v2ScenarioStep `json:"steps"`
+	State    string           `json:"state,omitempty"`
+	Step     int              `json:"step,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Started  *time.Time       `json:"started,omitempty"`
+	Finished *time.Time       `json:"finished,omitempty"`
+}
+
+//A v2Listener is a session with a dedicated listener.
+type v2Listener struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+//v2Access is the access mode of the package level sessions. The precedence only
+//applies to the combined mode.
+type v2Access struct {
+	Mode       string `json:"mode"`
+	Precedence string `json:"precedence,omitempty"`
+}
+
+func toV2Session(s *dsp.Session) v2Session {
+	return v2Session{s.Name, s.Username, s.Sources, s.Addr, s.Created}
+}
+
+func toV2Rule(rule dsp.Rule) v2Rule {
+	v := v2Rule{ID: rule.ID, Type: rule.Type, Host: rule.Host, Match: rule.Match, Priority: rule.Priority}
+	if v.Host == "" {
+		v.Host = rule.Match
+	}
+	v.Count = &rule.Count
+	v.FailureRate = rule.FailureRate
+	if rule.Latency > 0 {
+		v.Latency = rule.Latency.String()
+	}
+	if !rule.Start.IsZero() {
+		v.Start = &rule.Start
+	}
+	if !rule.Expires.IsZero() {
+		v.Expires = &rule.Expires
+		v.TTL = rule.TTL().String()
+	}
+	if rule.Ramp != nil {
+		v.Ramp = &v2Ramp{rule.Ramp.Up.String(), rule.Ramp.Hold.String(), rule.Ramp.Down.String()}
+	}
+	if rule.UDP != nil {
+		v.DuplicateRate, v.ReorderRate, v.Truncate = rule.UDP.DuplicateRate, rule.UDP.ReorderRate, rule.UDP.Truncate
+	}
+	return v
+}
+
+func toV2Schedule(sc dsp.Schedule) v2Schedule {
+	v := v2Schedule{Name: sc.Name, Host: sc.Host, Type: sc.Type, Count: &sc.Count, Duration: sc.Duration.String(), Cron: sc.Cron}
+	if sc.Latency > 0 {
+		v.Latency = sc.Latency.String()
+	}
+	if sc.Every > 0 {
+		v.Every = sc.Every.String()
+	}
+	if !sc.Next.IsZero() {
+		v.Next = &sc.Next
+	}
+	return v
+}
+
+func (v v2Schedule) toSchedule() (dsp.Schedule, error) {
+	var err error
+	sc := dsp.Schedule{Name: v.Name, Host: v.Host, Type: v.Type, Count: -1, Cron: v.Cron}
+	if v.Count != nil {
+		if *v.Count == 0 {
+			return sc, fmt.Errorf("schedule count must be > 0, or < 0 for no limit")
+		}
+		sc.Count = *v.Count
+	}
+	for _, field := range []struct {
+		name, s string
+		d       *time.Duration
+	}{{"latency", v.Latency, &sc.Latency}, {"duration", v.Duration, &sc.Duration}, {"every", v.Every, &sc.Every}} {
+		if field.s == "" {
+			continue
+		}
+		if *field.d, err = time.ParseDuration(field.s); err != nil {
+			return sc, fmt.Errorf("invalid %v: %v", field.name, err)
+		}
+	}
+	return sc, nil
+}
+
+func toV2Scenario(status dsp.ScenarioStatus) v2Scenario {
+	v := v2Scenario{Name: status.Name, Session: status.Session, Steps: []v2ScenarioStep{}, State: status.State, Step: status.Step, Error: status.Error}
+	for _, step := range status.Steps {
+		v.Steps = append(v.Steps, v2ScenarioStep(step))
+	}
+	if !status.Started.IsZero() {
+		v.Started = &status.Started
+	}
+	if !status.Finished.IsZero() {
+		v.Finished = &status.Finished
+	}
+	return v
+}
+
+func (v v2Rule) toRule() (dsp.Rule, error) {
+	var err error
+	rule := dsp.Rule{Type: v.Type, Host: v.Host, Priority: v.Priority}
+	if v.Host == "" {
+		return rule, fmt.Errorf("host is required")
+	}
+	rule.Count = -1
+	if v.Count != nil {
+		rule.Count = *v.Count
+	}
+	rule.FailureRate = v.FailureRate
+	if v.Latency != "" {
+		if rule.Latency, err = time.ParseDuration(v.Latency); err != nil {
+			return rule, fmt.Errorf("invalid latency: %v", err)
+		}
+	}
+	if v.Start != nil {
+		rule.Start = *v.Start
+	}
+	if v.Expires != nil && v.TTL != "" {
+		return rule, fmt.Errorf("expires and ttl can't be used at the same time")
+	}
+	if v.Expires != nil {
+		rule.Expires = *v.Expires
+	}
+	if v.TTL != "" {
+		ttl, err := time.ParseDuration(v.TTL)
+		if err != nil {
+			return rule, fmt.Errorf("invalid ttl: %v", err)
+		}
+		start := rule.Start
+		if start.IsZero() {
+			start = time.Now()
+		}
+		rule.Expires = start.Add(ttl)
+	}
+	if v.Ramp != nil {
+		rule.Ramp = &dsp.Ramp{}
+		for _, field := range []struct {
+			s string
+			d *time.Duration
+		}{{v.Ramp.Up, &rule.Ramp.Up}, {v.Ramp.Hold, &rule.Ramp.Hold}, {v.Ramp.Down, &rule.Ramp.Down}} {
+			if field.s == "" {
+				continue
+			}
+			if *field.d, err = time.ParseDuration(field.s); err != nil {
+				return rule, fmt.Errorf("invalid ramp: %v", err)
+			}
+		}
+	}
+	if udp := (dsp.UDPFaults{DuplicateRate: v.DuplicateRate, ReorderRate: v.ReorderRate, Truncate: v.Truncate}); udp != (dsp.UDPFaults{}) {
+		rule.UDP = &udp
+	}
+	return rule, nil
+}
+
+//v2 wraps handlers that return a status and a json body, or an error. A nil body
+//writes the status only.
+func v2(fn func(ctx *macaron.Context) (int, interface{}, error)) func(ctx *macaron.Context) {
+	return func(ctx *macaron.Context) {
+		status, body, err := fn(ctx)
+		if err != nil {
+			status, code := 400, "invalid_request"
+			switch {
+			case errors.Is(err, dsp.ErrNotFound):
+				status, code = 404, "not_found"
+			case errors.Is(err, dsp.ErrConflict):
+				status, code = 409, "conflict"
+			case errors.Is(err, dsp.ErrInternal):
+				status, code = 500, "internal_error"
+			}
+			ctx.JSON(status, map[string]v2Error{"error": {code, err.Error()}})
+			return
+		}
+		if body == nil {
+			ctx.Status(status)
+			return
+		}
+		ctx.JSON(status, body)
+	}
+}
+
+func decode(ctx *macaron.Context, v interface{}) error {
+	decoder := json.NewDecoder(ctx.Req.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid json body: %v", err)
+	}
+	return nil
+}
+
+func registerV2(app *macaron.Macaron) {
+	app.Get("/v2/openapi.json", func(ctx *macaron.Context) {
+		ctx.Resp.Header().Set("Content-Type", "application/json")
+		ctx.Resp.Write([]byte(openapi))
+	})
+
+	app.Get("/v2/sessions", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		sessions := []v2Session{toV2Session(dsp.DefaultSession)}
+		for _, name := range dsp.SessionNames() {
+			if s, err := dsp.GetSession(name); err == nil {
+				sessions = append(sessions, toV2Session(s))
+			}
+		}
+		return 200, sessions, nil
+	}))
+	app.Post("/v2/sessions", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		var v v2Session
+		if err := decode(ctx, &v); err != nil {
+			return 0, nil, err
+		}
+		s, err := dsp.CreateSession(v.Name, v.Username, v.Sources, v.Addr)
+		if err != nil {
+			return 0, nil, err
+		}
+		return 201, toV2Session(s), nil
+	}))
+	app.Get("/v2/sessions/:session", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		s, err := dsp.GetSession(ctx.Params("session"))
+		if err != nil {
+			return 0, nil, err
+		}
+		return 200, toV2Session(s), nil
+	}))
+	app.Delete("/v2/sessions/:session", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		return 204, nil, dsp.DeleteSession(ctx.Params("session"))
+	}))
+
+	app.Get("/v2/sessions/:session/rules", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		s, err := dsp.GetSession(ctx.Params("session"))
+		if err != nil {
+			return 0, nil, err
+		}
+		rules := []v2Rule{}
+		for _, rule := range s.ListRules() {
+			rules = append(rules, toV2Rule(rule))
+		}
+		return 200, rules, nil
+	}))
+	app.Post("/v2/sessions/:session/rules", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		s, err := dsp.GetSession(ctx.Params("session"))
+		if err != nil {
+			return 0, nil, err
+		}
+		var v v2Rule
+		if err := decode(ctx, &v); err != nil {
+			return 0, nil, err
+		}
+		rule, err := v.toRule()
+		if err != nil {
+			return 0, nil, err
+		}
+		if rule, err = s.AddRule(rule); err != nil {
+			return 0, nil, err
+		}
+		return 201, toV2Rule(rule), nil
+	}))
+	app.Get("/v2/sessions/:session/rules/:id", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		s, err := dsp.GetSession(ctx.Params("session"))
+		if err != nil {
+			return 0, nil, err
+		}
+		rule, err := s.GetRule(ctx.Params("id"))
+		if err != nil {
+			return 0, nil, err
+		}
+		return 200, toV2Rule(rule), nil
+	}))
+	app.Put("/v2/sessions/:session/rules/:id", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		s, err := dsp.GetSession(ctx.Params("session"))
+		if err != nil {
+			return 0, nil, err
+		}
+		var v v2Rule
+		if err := decode(ctx, &v); err != nil {
+			return 0, nil, err
+		}
+		rule, err := v.toRule()
+		if err != nil {
+			return 0, nil, err
+		}
+		if rule, err = s.UpdateRule(ctx.Params("id"), rule); err != nil {
+			return 0, nil, err
+		}
+		return 200, toV2Rule(rule), nil
+	}))
+	app.Delete("/v2/sessions/:session/rules/:id", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		s, err := dsp.GetSession(ctx.Params("session"))
+		if err != nil {
+			return 0, nil, err
+		}
+		return 204, nil, s.DeleteRule(ctx.Params("id"))
+	}))
+
+	app.Get("/v2/sessions/:session/connections", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		s, err := dsp.GetSession(ctx.Params("session"))
+		if err != nil {
+			return 0, nil, err
+		}
+		conns := []v2Connection{}
+		for _, conn := range s.Connections() {
+			conns = append(conns, v2Connection{conn.ID, conn.Session, conn.Client, conn.Remote, conn.Started})
+		}
+		return 200, conns, nil
+	}))
+
+	app.Get("/v2/sessions/:session/counters", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		s, err := dsp.GetSession(ctx.Params("session"))
+		if err != nil {
+			return 0, nil, err
+		}
+		return 200, s.Counters(), nil
+	}))
+	app.Delete("/v2/sessions/:session/counters", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		s, err := dsp.GetSession(ctx.Params("session"))
+		if err != nil {
+			return 0, nil, err
+		}
+		s.ResetCounters()
+		return 204, nil, nil
+	}))
+
+	app.Get("/v2/sessions/:session/schedules", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		s, err := dsp.GetSession(ctx.Params("session"))
+		if err != nil {
+			return 0, nil, err
+		}
+		schedules := []v2Schedule{}
+		for _, sc := range s.Schedules() {
+			schedules = append(schedules, toV2Schedule(sc))
+		}
+		return 200, schedules, nil
+	}))
+	app.Post("/v2/sessions/:session/schedules", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		s, err := dsp.GetSession(ctx.Params("session"))
+		if err != nil {
+			return 0, nil, err
+		}
+		var v v2Schedule
+		if err := decode(ctx, &v); err != nil {
+			return 0, nil, err
+		}
+		sc, err := v.toSchedule()
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := s.AddSchedule(sc); err != nil {
+			return 0, nil, err
+		}
+		if sc, err = s.GetSchedule(sc.Name); err != nil {
+			return 0, nil, err
+		}
+		return 201, toV2Schedule(sc), nil
+	}))
+	app.Get("/v2/sessions/:session/schedules/:name", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		s, err := dsp.GetSession(ctx.Params("session"))
+		if err != nil {
+			return 0, nil, err
+		}
+		sc, err := s.GetSchedule(ctx.Params("name"))
+		if err != nil {
+			return 0, nil, err
+		}
+		return 200, toV2Schedule(sc), nil
+	}))
+	app.Delete("/v2/sessions/:session/schedules/:name", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		s, err := dsp.GetSession(ctx.Params("session"))
+		if err != nil {
+			return 0, nil, err
+		}
+		return 204, nil, s.RemoveSchedule(ctx.Params("name"))
+	}))
+
+	app.Get("/v2/scenarios", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		scenarios := []v2Scenario{}
+		for _, status := range dsp.ListScenarios() {
+			scenarios = append(scenarios, toV2Scenario(status))
+		}
+		return 200, scenarios, nil
+	}))
+	app.Post("/v2/scenarios", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		var v v2Scenario
+		if err := decode(ctx, &v); err != nil {
+			return 0, nil, err
+		}
+		sc := dsp.Scenario{Name: v.Name, Session: v.Session}
+		for _, step := range v.Steps {
+			sc.Steps = append(sc.Steps, dsp.ScenarioStep(step))
+		}
+		data, err := json.Marshal(&sc)
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, err := dsp.UploadScenario(data); err != nil {
+			return 0, nil, err
+		}
+		status, err := dsp.GetScenario(v.Name)
+		if err != nil {
+			return 0, nil, err
+		}
+		return 201, toV2Scenario(status), nil
+	}))
+	app.Get("/v2/scenarios/:name", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		status, err := dsp.GetScenario(ctx.Params("name"))
+		if err != nil {
+			return 0, nil, err
+		}
+		return 200, toV2Scenario(status), nil
+	}))
+	for action, fn := range map[string]func(string) error{"start": dsp.StartScenario, "pause": dsp.PauseScenario, "abort": dsp.AbortScenario} {
+		fn := fn
+		app.Post("/v2/scenarios/:name/"+action, v2(func(ctx *macaron.Context) (int, interface{}, error) {
+			if err := fn(ctx.Params("name")); err != nil {
+				return 0, nil, err
+			}
+			status, err := dsp.GetScenario(ctx.Params("name"))
+			if err != nil {
+				return 0, nil, err
+			}
+			return 200, toV2Scenario(status), nil
+		}))
+	}
+
+	app.Get("/v2/listeners", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		listeners := []v2Listener{}
+		for name, addr := range dsp.Listeners() {
+			listeners = append(listeners, v2Listener{name, addr})
+		}
+		sort.Slice(listeners, func(i, j int) bool { return listeners[i].Name < listeners[j].Name })
+		return 200, listeners, nil
+	}))
+	app.Post("/v2/listeners", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		var v v2Listener
+		if err := decode(ctx, &v); err != nil {
+			return 0, nil, err
+		}
+		s, err := dsp.CreateListener(v.Name, v.Addr)
+		if err != nil {
+			return 0, nil, err
+		}
+		return 201, v2Listener{s.Name, s.Addr}, nil
+	}))
+	app.Delete("/v2/listeners/:name", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		return 204, nil, dsp.DeleteListener(ctx.Params("name"))
+	}))
+
+	app.Get("/v2/access", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		return 200, v2Access(dsp.GetAccessMode()), nil
+	}))
+	app.Put("/v2/access", v2(func(ctx *macaron.Context) (int, interface{}, error) {
+		var v v2Access
+		if err := decode(ctx, &v); err != nil {
+			return 0, nil, err
+		}
+		if err := dsp.SetAccessMode(dsp.AccessMode(v)); err != nil {
+			return 0, nil, err
+		}
+		return 200, v2Access(dsp.GetAccessMode()), nil
+	}))
+}
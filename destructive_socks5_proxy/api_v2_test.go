@@ -0,0 +1,132 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Unknwon/macaron"
+	dsp "github.com/intuit/destructive_socks5_proxy"
+)
+
+//call sends a json request to the admin API and decodes the response into out,
+//if set, and returns the status.
+func call(t *testing.T, method, url, body string, out interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatal("unexpected body", string(data), err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestV2Resources(t *testing.T) {
+	app := macaron.New()
+	registerV2(app)
+	registerState(app)
+	admin := httptest.NewServer(app)
+	defer admin.Close()
+
+	//schedules
+	if _, err := dsp.CreateSession("v2-schedules", "", nil, ""); err != nil {
+		t.Fatal("got error", err)
+	}
+	var sc v2Schedule
+	if status := call(t, "POST", admin.URL+"/v2/sessions/v2-schedules/schedules", `{"name": "outage", "host": "localhost", "type": "blacklist", "duration": "1s", "every": "1h"}`, &sc); status != 201 || sc.Next == nil || *sc.Count != -1 {
+		t.Error("unexpected schedule", status, sc)
+	}
+	var schedules []v2Schedule
+	if status := call(t, "GET", admin.URL+"/v2/sessions/v2-schedules/schedules", "", &schedules); status != 200 || len(schedules) != 1 || schedules[0].Every != "1h0m0s" {
+		t.Error("unexpected schedules", status, schedules)
+	}
+	if status := call(t, "POST", admin.URL+"/v2/sessions/v2-schedules/schedules", `{"name": "long", "host": "localhost", "type": "blacklist", "duration": "1h", "every": "1h"}`, nil); status != 400 {
+		t.Error("expected a 400, got", status)
+	}
+	if status := call(t, "DELETE", admin.URL+"/v2/sessions/v2-schedules/schedules/outage", "", nil); status != 204 {
+		t.Error("expected a 204, got", status)
+	}
+	if status := call(t, "GET", admin.URL+"/v2/sessions/v2-schedules/schedules/outage", "", nil); status != 404 {
+		t.Error("expected a 404, got", status)
+	}
+	dsp.DeleteSession("v2-schedules")
+
+	//scenarios
+	var scenario v2Scenario
+	if status := call(t, "POST", admin.URL+"/v2/scenarios", `{"name": "v2", "steps": [{"action": "wait", "duration": "1h"}]}`, &scenario); status != 201 || scenario.State != dsp.SCENARIO_READY || len(scenario.Steps) != 1 {
+		t.Error("unexpected scenario", status, scenario)
+	}
+	if status := call(t, "POST", admin.URL+"/v2/scenarios/v2/start", "", &scenario); status != 200 || scenario.State != dsp.SCENARIO_RUNNING || scenario.Started == nil {
+		t.Error("unexpected scenario", status, scenario)
+	}
+	if status := call(t, "POST", admin.URL+"/v2/scenarios/v2/abort", "", &scenario); status != 200 || scenario.State != dsp.SCENARIO_ABORTED {
+		t.Error("unexpected scenario", status, scenario)
+	}
+	if status := call(t, "POST", admin.URL+"/v2/scenarios", `{"name": "invalid", "steps": [{"action": "explode"}]}`, nil); status != 400 {
+		t.Error("expected a 400, got", status)
+	}
+
+	//listeners, with a 500 for an address in use
+	var listener v2Listener
+	if status := call(t, "POST", admin.URL+"/v2/listeners", `{"name": "v2-listener", "addr": "127.0.0.1:0"}`, &listener); status != 201 || strings.HasSuffix(listener.Addr, ":0") {
+		t.Fatal("unexpected listener", status, listener)
+	}
+	defer dsp.DeleteSession("v2-listener")
+	var failure map[string]v2Error
+	if status := call(t, "POST", admin.URL+"/v2/listeners", `{"name": "v2-in-use", "addr": "`+listener.Addr+`"}`, &failure); status != 500 || failure["error"].Code != "internal_error" {
+		t.Error("expected an internal error", status, failure)
+	}
+	if status := call(t, "POST", admin.URL+"/v2/listeners", `{"name": "v2-invalid", "addr": "127.0.0.1"}`, nil); status != 400 {
+		t.Error("expected a 400, got", status)
+	}
+	var listeners []v2Listener
+	if status := call(t, "GET", admin.URL+"/v2/listeners", "", &listeners); status != 200 || len(listeners) != 1 || listeners[0] != listener {
+		t.Error("unexpected listeners", status, listeners)
+	}
+
+	//state
+	var state stateConfig
+	if status := call(t, "GET", admin.URL+"/v2/state", "", &state); status != 200 || len(state.Sessions) != 1 || state.Sessions[0].Addr != listener.Addr {
+		t.Fatal("unexpected state", status, state)
+	}
+	data, _ := json.Marshal(state)
+	if status := call(t, "PUT", admin.URL+"/v2/state", string(data), &state); status != 200 || len(state.Sessions) != 1 {
+		t.Error("unexpected state", status, state)
+	}
+	if status := call(t, "DELETE", admin.URL+"/v2/listeners/v2-listener", "", nil); status != 204 {
+		t.Error("expected a 204, got", status)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	var doc struct {
+		Paths map[string]interface{}
+	}
+	if err := json.Unmarshal([]byte(openapi), &doc); err != nil {
+		t.Fatal("got error", err)
+	}
+	for _, path := range []string{"/v2/sessions/{session}/schedules/{name}", "/v2/scenarios/{name}/start", "/v2/listeners/{name}", "/v2/state"} {
+		if doc.Paths[path] == nil {
+			t.Error("expected the document to describe", path)
+		}
+	}
+}
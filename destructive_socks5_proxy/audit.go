@@ -0,0 +1,221 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/araddon/gou"
+	dsp "github.com/intuit/destructive_socks5_proxy"
+)
+
+//An auditRecord is a change made through the admin API, written as a line of json.
+type auditRecord struct {
+	Time     time.Time   `json:"time"`
+	Caller   string      `json:"caller"`  //token name, certificate common name or address
+	Address  string      `json:"address"` //remote address of the caller
+	Request  string      `json:"request"` //method and url
+	Status   int         `json:"status"`
+	Item     string      `json:"item,omitempty"` //e.g. rule ci-1/Xb2k9LqZ0aP1, session ci-1
+	Previous interface{} `json:"previous"`       //null if the item was created
+	New      interface{} `json:"new"`            //null if the item was removed
+}
+
+//auditLog records the changes made by mutating requests of the admin API, by
+//comparing the state of the proxy before and after them. Mutating requests are
+//serialized so each record only has the changes of its request. Rules counted down
+//by traffic, or removed once used up or expired, aren't changes of the request.
+type auditLog struct {
+	sync sync.Mutex
+	out  io.Writer //nil to only log the records
+}
+
+func newAuditLog(path string) (*auditLog, error) {
+	audit := &auditLog{}
+	switch path {
+	case "":
+	case "-":
+		audit.out = os.Stdout
+	default:
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		audit.out = f
+	}
+	return audit, nil
+}
+
+//auditState is a snapshot of the state the admin API can change, by item.
+type auditState map[string]interface{}
+
+type auditScenario struct {
+	Session string `json:"session,omitempty"`
+	State   string `json:"state"`
+}
+
+var countersReset = regexp.MustCompile(`^/v2/sessions/([^/]+)/counters$`)
+
+//countersSession returns the session whose counters r resets, if any. Counters
+//change with traffic, so they are only compared for resets.
+func countersSession(r *http.Request) (string, bool) {
+	if r.URL.Path == "/counters/reset" {
+		return r.URL.Query().Get("session"), true
+	}
+	if m := countersReset.FindStringSubmatch(r.URL.Path); m != nil && r.Method == "DELETE" {
+		return m[1], true
+	}
+	return "", false
+}
+
+func snapshot(r *http.Request) auditState {
+	state := auditState{"access": v2Access(dsp.GetAccessMode())}
+	sessions := []*dsp.Session{dsp.DefaultSession}
+	for _, name := range dsp.SessionNames() {
+		if s, err := dsp.GetSession(name); err == nil {
+			sessions = append(sessions, s)
+			state["session "+name] = toV2Session(s)
+		}
+	}
+	for _, s := range sessions {
+		for _, rule := range s.ListRules() {
+			v := toV2Rule(rule)
+			v.TTL = "" //the time left changes between snapshots, expires doesn't
+			state[fmt.Sprintf("rule %v/%v", s.Name, rule.ID)] = v
+		}
+		for _, sc := range s.Schedules() {
+			sc.Next = time.Time{}
+			state[fmt.Sprintf("schedule %v/%v", s.Name, sc.Name)] = sc
+		}
+	}
+	for _, sc := range dsp.ListScenarios() {
+		state["scenario "+sc.Name] = auditScenario{sc.Session, sc.State}
+	}
+	if name, ok := countersSession(r); ok {
+		if s, err := dsp.GetSession(name); err == nil {
+			state["counters "+s.Name] = s.Counters()
+		}
+	}
+	return state
+}
+
+//diff returns the records of the items that differ between previous and next,
+//or a single record without an item if none do.
+func diff(previous, next auditState, record auditRecord) []auditRecord {
+	items := []string{}
+	for item := range previous {
+		items = append(items, item)
+	}
+	for item := range next {
+		if _, exists := previous[item]; !exists {
+			items = append(items, item)
+		}
+	}
+	sort.Strings(items)
+
+	records := []auditRecord{}
+	for _, item := range items {
+		if reflect.DeepEqual(previous[item], next[item]) || byTraffic(previous[item], next[item], record.Time) {
+			continue
+		}
+		r := record
+		r.Item, r.Previous, r.New = item, previous[item], next[item]
+		records = append(records, r)
+	}
+	if len(records) == 0 {
+		records = append(records, record)
+	}
+	return records
+}
+
+//byTraffic reports whether the rule previous changed to next without the request,
+//as traffic counts it down, uses it up or it expires before now.
+func byTraffic(previous, next interface{}, now time.Time) bool {
+	p, ok := previous.(v2Rule)
+	if !ok {
+		return false
+	}
+	if next == nil {
+		return p.Count != nil && *p.Count == 0 || p.Expires != nil && !p.Expires.After(now)
+	}
+	n, ok := next.(v2Rule)
+	p.Count, n.Count = nil, nil
+	return ok && reflect.DeepEqual(p, n)
+}
+
+func (audit *auditLog) write(records []auditRecord) {
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			gou.Errorf("Failed to marshal audit record. err=%v", err)
+			continue
+		}
+		gou.Infof("Audit %s", line)
+		if audit.out != nil {
+			if _, err := audit.out.Write(append(line, '\n')); err != nil {
+				gou.Errorf("Failed to write audit record. err=%v", err)
+			}
+		}
+	}
+}
+
+//statusRecorder records the status written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+//handler records the changes of the mutating requests to next.
+func (audit *auditLog) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !mutating(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		audit.sync.Lock()
+		defer audit.sync.Unlock()
+		previous := snapshot(r)
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = 200
+		}
+
+		c := callerOf(r)
+		record := auditRecord{
+			Time:    time.Now().UTC(),
+			Caller:  c.Name,
+			Address: r.RemoteAddr,
+			Request: r.Method + " " + r.URL.RequestURI(),
+			Status:  recorder.status,
+		}
+		audit.write(diff(previous, snapshot(r), record))
+	})
+}
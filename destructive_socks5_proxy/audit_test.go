@@ -0,0 +1,78 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dsp "github.com/intuit/destructive_socks5_proxy"
+)
+
+//TestAuditTraffic checks that the rules traffic and time change during a request
+//aren't recorded as its changes.
+func TestAuditTraffic(t *testing.T) {
+	s, err := dsp.CreateListener("audited", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer dsp.DeleteSession("audited")
+	upstreams := []*net.TCPAddr{}
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+		l, err := net.Listen("tcp", ip+":0")
+		if err != nil {
+			t.Fatal("got error", err)
+		}
+		defer l.Close()
+		upstreams = append(upstreams, l.Addr().(*net.TCPAddr))
+	}
+	rule := func(_type, host string, count int, expires time.Time) {
+		t.Helper()
+		_, err := s.AddRule(dsp.Rule{Type: _type, Host: host, LatencyAndCountStruct: dsp.LatencyAndCountStruct{Latency: time.Millisecond, Count: count, Expires: expires}})
+		if err != nil {
+			t.Fatal("got error", err)
+		}
+	}
+	rule(dsp.PER_REMOTE_CONNECT, "127.0.0.1", 2, time.Time{})
+	rule(dsp.PER_REMOTE_CONNECT, "127.0.0.2", 1, time.Time{})
+	rule(dsp.PER_REMOTE_WRITE, "127.0.0.1", -1, time.Now().Add(100*time.Millisecond))
+	socks5Connect(t, s.Addr, upstreams[1]) //used up
+
+	mode := dsp.GetAccessMode()
+	defer dsp.SetAccessMode(mode)
+	out := &bytes.Buffer{}
+	audit := &auditLog{out: out}
+	handler := audit.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		socks5Connect(t, s.Addr, upstreams[0]) //counted down
+		socks5Connect(t, s.Addr, upstreams[1]) //removed once used up
+		time.Sleep(200 * time.Millisecond)     //expired
+		if err := dsp.SetAccessMode(dsp.AccessMode{Mode: dsp.MODE_BLACKLIST}); err != nil {
+			t.Error("got error", err)
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v2/access", nil))
+
+	if len(s.ListRules()) != 1 {
+		t.Fatal("expected traffic and time to change the rules", s.ListRules())
+	}
+	records := []auditRecord{}
+	for decoder := json.NewDecoder(out); decoder.More(); {
+		var record auditRecord
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal("got error", err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 1 || records[0].Item != "access" {
+		t.Error("expected only the access mode to be recorded", records)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Unknwon/macaron"
+	dsp "github.com/intuit/destructive_socks5_proxy"
+	"github.com/intuit/destructive_socks5_proxy/client"
+)
+
+//TestClient calls the v2 handlers with the client package.
+func TestClient(t *testing.T) {
+	app := macaron.New()
+	registerV2(app)
+	admin := httptest.NewServer(app)
+	defer admin.Close()
+	c := client.New(admin.URL)
+	defer c.ClearRules()
+
+	rule, err := c.SetRule(client.Rule{Type: client.PER_REMOTE_WRITE, Host: "localhost", Latency: 200 * time.Millisecond, Count: client.NO_LIMIT, TTL: 10 * time.Minute})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if rule.Host != "localhost" || rule.Match != "127.0.0.1" || rule.Count != client.NO_LIMIT || rule.Expires.IsZero() || rule.TTL <= 0 {
+		t.Error("unexpected rule", rule)
+	}
+
+	//a rule read back can be updated as is
+	got, err := c.GetRule(rule.ID)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	got.Latency = time.Second
+	updated, err := c.UpdateRule(got.ID, got)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if updated.Latency != time.Second || !updated.Expires.Equal(rule.Expires) {
+		t.Error("expected the rule to keep its expiry", updated, rule)
+	}
+	if _, err := c.SetRule(updated); err != nil {
+		t.Error("got error", err)
+	}
+	if rules := dsp.DefaultSession.ListRules(); len(rules) != 1 {
+		t.Error("expected one rule", rules)
+	}
+}
+
+//socks5Connect connects to the ipv4 address addr through the SOCKS5 proxy, and
+//closes the connection once connected.
+func socks5Connect(t *testing.T, proxy string, addr *net.TCPAddr) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer conn.Close()
+	request := append([]byte{5, 1, 0, 5, 1, 0, 1}, addr.IP.To4()...)
+	conn.Write(append(request, byte(addr.Port>>8), byte(addr.Port)))
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[3] != 0 {
+		t.Fatal("expected the connect to succeed", reply, err)
+	}
+}
+
+//TestClientExhaustedRule checks that a used up rule read back isn't set again with
+//no limit.
+func TestClientExhaustedRule(t *testing.T) {
+	app := macaron.New()
+	registerV2(app)
+	admin := httptest.NewServer(app)
+	defer admin.Close()
+	s, err := dsp.CreateListener("exhausted", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer dsp.DeleteSession("exhausted")
+	c := client.New(admin.URL).ForSession("exhausted")
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer upstream.Close()
+
+	rule, err := c.SetRule(client.Rule{Type: client.PER_REMOTE_CONNECT, Host: "127.0.0.1", Latency: time.Millisecond, Count: 1})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	socks5Connect(t, s.Addr, upstream.Addr().(*net.TCPAddr))
+
+	got, err := c.GetRule(rule.ID)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if got.Count != 0 {
+		t.Error("expected the rule to be used up", got)
+	}
+	if _, err := c.UpdateRule(got.ID, got); err == nil {
+		t.Error("expected an error updating a used up rule")
+	}
+	if got, _ = c.GetRule(rule.ID); got.Count != 0 {
+		t.Error("expected the rule to stay used up", got)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	dsp "github.com/intuit/destructive_socks5_proxy"
+)
+
+//config is the json file of the -config flag: the admin settings and the fault
+//state, as exported by /state/export.
+type config struct {
+	Admin *adminConfig `json:"admin,omitempty"`
+	stateConfig
+}
+
+//stateConfig is the fault state: whether the blacklist and the whitelist are
+//enabled and their precedence, the rules of the default session, and the other
+//sessions.
+type stateConfig struct {
+	Blacklist  bool            `json:"blacklist"`
+	Whitelist  bool            `json:"whitelist"`
+	Precedence string          `json:"precedence,omitempty"`
+	Rules      []v2Rule        `json:"rules"`
+	Sessions   []sessionConfig `json:"sessions,omitempty"`
+}
+
+type sessionConfig struct {
+	Name     string   `json:"name"`
+	Username string   `json:"username,omitempty"`
+	Sources  []string `json:"sources,omitempty"`
+	Addr     string   `json:"addr,omitempty"`
+	Rules    []v2Rule `json:"rules"`
+}
+
+//adminConfig configures the admin API.
+type adminConfig struct {
+	Addr        string            `json:"addr,omitempty"`
+	Tokens      []adminToken      `json:"tokens,omitempty"`
+	TLSCert     string            `json:"tls_cert,omitempty"`
+	TLSKey      string            `json:"tls_key,omitempty"`
+	ClientCA    string            `json:"client_ca,omitempty"`
+	ClientRoles map[string]string `json:"client_roles,omitempty"`
+	AuditLog    string            `json:"audit_log,omitempty"`
+}
+
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	conf := &config{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(conf); err != nil {
+		return nil, fmt.Errorf("invalid config %v: %v", path, err)
+	}
+	return conf, nil
+}
+
+//parseClientRoles parses a csv list of common name=role.
+func parseClientRoles(csv string) (map[string]string, error) {
+	roles := map[string]string{}
+	for _, pair := range strings.Split(csv, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid client role %q, expected name=role", pair)
+		}
+		roles[parts[0]] = parts[1]
+	}
+	return roles, nil
+}
+
+func toStateConfig(state dsp.State) stateConfig {
+	conf := stateConfig{Blacklist: state.Blacklist, Whitelist: state.Whitelist, Precedence: state.Precedence, Rules: []v2Rule{}}
+	for _, ss := range state.Sessions {
+		rules := []v2Rule{}
+		for _, rule := range ss.Rules {
+			v := toV2Rule(rule)
+			v.Host, v.TTL = rule.Host, "" //the host it was set with, and when it expires
+			rules = append(rules, v)
+		}
+		if ss.Name == dsp.DefaultSession.Name {
+			conf.Rules = rules
+			continue
+		}
+		conf.Sessions = append(conf.Sessions, sessionConfig{ss.Name, ss.Username, ss.Sources, ss.Addr, rules})
+	}
+	return conf
+}
+
+func toRules(rules []v2Rule) ([]dsp.Rule, error) {
+	result := []dsp.Rule{}
+	for _, v := range rules {
+		rule, err := v.toRule()
+		if err != nil {
+			return nil, fmt.Errorf("%v rule for %v: %v", v.Type, v.Host, err)
+		}
+		rule.ID = v.ID
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+func (conf stateConfig) toState() (dsp.State, error) {
+	state := dsp.State{Blacklist: conf.Blacklist, Whitelist: conf.Whitelist, Precedence: conf.Precedence}
+	rules, err := toRules(conf.Rules)
+	if err != nil {
+		return state, err
+	}
+	state.Sessions = append(state.Sessions, dsp.SessionState{Name: dsp.DefaultSession.Name, Rules: rules})
+	for _, s := range conf.Sessions {
+		if s.Name == "" || s.Name == dsp.DefaultSession.Name {
+			return state, fmt.Errorf("invalid session name %q, the rules of the default session are set with rules", s.Name)
+		}
+		rules, err := toRules(s.Rules)
+		if err != nil {
+			return state, fmt.Errorf("session %v: %v", s.Name, err)
+		}
+		state.Sessions = append(state.Sessions, dsp.SessionState{Name: s.Name, Username: s.Username, Sources: s.Sources, Addr: s.Addr, Rules: rules})
+	}
+	return state, nil
+}
@@ -9,9 +9,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Unknwon/macaron"
@@ -39,39 +44,254 @@ func assertErr(err error, msg string) {
 	}
 }
 
+//Formats the time left until rule expires.
+func ttl(rule dsp.LatencyAndCountStruct) string {
+	if rule.TTL() < 0 {
+		return "none"
+	}
+	return rule.TTL().String()
+}
+
+//Formats the ramp of rule.
+func ramp_string(rule dsp.LatencyAndCountStruct) string {
+	if rule.Ramp == nil {
+		return "none"
+	}
+	return fmt.Sprintf("up %v, hold %v, down %v", rule.Ramp.Up, rule.Ramp.Hold, rule.Ramp.Down)
+}
+
+//Returns the hosts of the session's _type rules.
+func rule_hosts(s *dsp.Session, _type string) []string {
+	hosts := []string{}
+	for _, rule := range s.ListRules() {
+		if rule.Type == _type {
+			hosts = append(hosts, rule.Match)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+//Returns the session's _type rules by host.
+func rules_by_host(s *dsp.Session, _type string) map[string]dsp.LatencyAndCountStruct {
+	rules := make(map[string]dsp.LatencyAndCountStruct)
+	for _, rule := range s.ListRules() {
+		if rule.Type == _type {
+			rules[rule.Match] = rule.LatencyAndCountStruct
+		}
+	}
+	return rules
+}
+
+//Returns the session named by the session query param, the default session if unset.
+func session(ctx *macaron.Context) *dsp.Session {
+	s, err := dsp.GetSession(ctx.Req.URL.Query().Get("session"))
+	assertErr(err, "")
+	return s
+}
+
 func main() {
+	gou.SetupLogging("debug")
+	gou.SetColorIfTerminal()
 
 	wl := flag.String("whitelist", "", "csv list of hosts to whitelist.")
 	bl := flag.String("blacklist", "", "csv list of hosts to blacklist")
-	addr := flag.String("addr", "0.0.0.0:9000", "address to listen on")
-	config := flag.String("config", "todo", "optional json config file of host:latency:type")
+	denied_reply := flag.Int("denied-reply", dsp.REPLY_NOT_ALLOWED, "SOCKS5 reply code sent to clients whose request the access mode denies")
+	precedence := flag.String("precedence", "", "deny or allow, which list wins when both -whitelist and -blacklist are set. Defaults to deny")
+	addr := flag.String("addr", "0.0.0.0:9000", "address to listen on, or http://host:port to serve an HTTP proxy instead of SOCKS")
+	http_addr := flag.String("http-addr", "", "optional address of an HTTP proxy listener, next to the SOCKS listener of -addr")
+	forwards := flag.String("forwards", "", "csv list of listen->target port forwards, e.g. 127.0.0.1:15432->db.internal:5432, for clients that can't use a proxy")
+	listeners := flag.String("listeners", "", "csv list of name=addr listeners, each with its own rules and counters. addr can be http://host:port for an HTTP proxy, or listen->target for a port forward")
+	config_file := flag.String("config", "", "optional json config file")
+	drain_timeout := flag.Duration("drain-timeout", 30*time.Second, "on SIGTERM or SIGINT, time to wait for active connections before closing them")
+	counters_file := flag.String("counters-file", "", "optional file to write the final counters to on shutdown")
+	state_file := flag.String("state-file", "", "optional file the fault state is saved to on every change, and restored from at startup")
+	state_save_interval := flag.Duration("state-save-interval", 10*time.Second, "interval at which -state-file is saved for the rules that count down or expire")
+	admin_addr := flag.String("admin-addr", "", "address of the admin API, host:port or unix:/path/to/socket. Defaults to $HOST:$PORT, or 0.0.0.0:4000")
+	admin_token := flag.String("admin-token", "", "bearer token of the admin API with the write role")
+	admin_read_token := flag.String("admin-read-token", "", "bearer token of the admin API with the read role")
+	admin_tls_cert := flag.String("admin-tls-cert", "", "certificate file to serve the admin API over TLS")
+	admin_tls_key := flag.String("admin-tls-key", "", "key file of -admin-tls-cert")
+	admin_client_ca := flag.String("admin-client-ca", "", "CA file of the client certificates accepted by the admin API")
+	audit_log := flag.String("audit-log", "", "file to append a json line to for every change made through the admin API, - for stdout")
+	admin_client_roles := flag.String("admin-client-roles", "", "csv list of common name=read|write roles of client certificates, * for any. Defaults to *=write")
 
 	flag.Parse()
 
-	if *wl != "" && *bl != "" {
-		fmt.Println("Can't set whitelist & blacklist")
+	if *denied_reply < 1 || *denied_reply > 255 {
+		fmt.Printf("invalid -denied-reply %v, expected a SOCKS5 reply code from 1 to 255\n", *denied_reply)
 		return
 	}
+	dsp.DeniedReply = byte(*denied_reply)
+
+	//the fault state of the config file, the lists of the flags add to it
+	conf := &config{}
+	if *config_file != "" {
+		var err error
+		if conf, err = loadConfig(*config_file); err != nil {
+			fmt.Println(err)
+			return
+		}
+		state, err := conf.toState()
+		if err == nil {
+			err = dsp.ImportState(state)
+		}
+		if err != nil {
+			fmt.Printf("invalid config %v: %v\n", *config_file, err)
+			return
+		}
+	}
+
+	//the saved state replaces the state of the config file
+	var persister *statePersister
+	if *state_file != "" {
+		persister = &statePersister{path: *state_file}
+		restored, err := persister.restore()
+		if err != nil {
+			fmt.Printf("invalid state file %v: %v\n", *state_file, err)
+			return
+		}
+		if restored {
+			gou.Infof("Restored the state from %v", *state_file)
+		}
+	}
+
+	//the lists of the flags enable their mode on top of the restored one
+	if *wl != "" || *bl != "" || *precedence != "" {
+		mode := dsp.GetAccessMode()
+		blacklist := *bl != "" || mode.Mode == dsp.MODE_BLACKLIST || mode.Mode == dsp.MODE_COMBINED
+		whitelist := *wl != "" || mode.Mode == dsp.MODE_WHITELIST || mode.Mode == dsp.MODE_COMBINED
+		switch {
+		case blacklist && whitelist:
+			mode.Mode = dsp.MODE_COMBINED
+		case blacklist:
+			mode.Mode = dsp.MODE_BLACKLIST
+		case whitelist:
+			mode.Mode = dsp.MODE_WHITELIST
+		}
+		if *precedence != "" {
+			mode.Precedence = *precedence
+		}
+		if err := dsp.SetAccessMode(mode); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
 
 	if *wl != "" {
-		dsp.Whitelist = true
 		for _, host := range strings.Split(*wl, ",") {
 			dsp.SetWhitelistForHost(host, true)
 		}
 	}
 
 	if *bl != "" {
-		dsp.Blacklist = true
 		for _, host := range strings.Split(*bl, ",") {
-			dsp.SetWhitelistForHost(host, true)
+			dsp.SetBlacklistForHost(host, true)
 		}
 	}
 
-	if *config != "todo" {
-		fmt.Println("config isn't implemented yet")
+	//flags add to the admin config of the config file
+	admin_conf := adminConfig{}
+	if conf.Admin != nil {
+		admin_conf = *conf.Admin
+	}
+	if *admin_token != "" {
+		admin_conf.Tokens = append(admin_conf.Tokens, adminToken{Token: *admin_token, Role: ROLE_WRITE})
+	}
+	if *admin_read_token != "" {
+		admin_conf.Tokens = append(admin_conf.Tokens, adminToken{Token: *admin_read_token, Role: ROLE_READ})
+	}
+	for flag_value, conf_value := range map[*string]*string{admin_tls_cert: &admin_conf.TLSCert, admin_tls_key: &admin_conf.TLSKey, admin_client_ca: &admin_conf.ClientCA} {
+		if *flag_value != "" {
+			*conf_value = *flag_value
+		}
+	}
+	if *admin_client_roles != "" {
+		roles, err := parseClientRoles(*admin_client_roles)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if admin_conf.ClientRoles == nil {
+			admin_conf.ClientRoles = map[string]string{}
+		}
+		for name, role := range roles {
+			admin_conf.ClientRoles[name] = role
+		}
+	}
+	if (admin_conf.TLSCert == "") != (admin_conf.TLSKey == "") {
+		fmt.Println("The admin TLS certificate and key must be set together")
+		return
+	}
+	auth, err := newAdminAuth(admin_conf)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(auth.tokens) > 0 && admin_conf.TLSCert == "" {
+		gou.Warn("Admin bearer tokens are sent in clear text without TLS. Set -admin-tls-cert and -admin-tls-key")
+	}
+
+	if *admin_addr == "" {
+		*admin_addr = admin_conf.Addr
+	}
+	if *admin_addr == "" {
+		*admin_addr = default_admin_addr()
+	}
+	if *audit_log == "" {
+		*audit_log = admin_conf.AuditLog
+	}
+	audit, err := newAuditLog(*audit_log)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	admin_listener, err := listen_admin(*admin_addr)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if *listeners != "" {
+		if err := dsp.CreateListeners(*listeners); err != nil {
+			fmt.Println(err)
+			return
+		}
 	}
 
 	go dsp.NewListenerForTcpCopyingProxy(*addr)
+	if *http_addr != "" {
+		go dsp.NewListenerForTcpCopyingProxy(dsp.PROTOCOL_HTTP + "://" + *http_addr)
+	}
+	if *forwards != "" {
+		for _, forward := range strings.Split(*forwards, ",") {
+			go dsp.NewListenerForTcpCopyingProxy(forward)
+		}
+	}
+
+	//stop accepting, drain and persist counters on shutdown
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		gou.Infof("Received %v", sig)
+		dsp.Shutdown(*drain_timeout)
+		if persister != nil {
+			persister.saveOrLog()
+		}
+		if *counters_file != "" {
+			if err := dsp.WriteCounters(*counters_file); err != nil {
+				gou.Errorf("Failed to write counters to %v. err=%v", *counters_file, err)
+				os.Exit(1)
+			}
+			gou.Infof("Wrote counters to %v", *counters_file)
+		}
+		//the admin API serves until exit, but leaves no socket behind
+		if admin_listener.Addr().Network() == "unix" {
+			os.Remove(admin_listener.Addr().String())
+		}
+		os.Exit(0)
+	}()
 
 	app := macaron.Classic()
 	app.Use(macaron.Renderer(macaron.RenderOptions{
@@ -79,45 +299,122 @@ func main() {
 	}))
 	app.Use(macaron.Recovery())
 
+	registerV1(app)
+	registerV2(app)
+	registerState(app)
+
+	handler := http.Handler(app)
+	if persister != nil {
+		persister.saveOrLog()
+		go persister.run(*state_save_interval)
+		handler = persister.handler(handler)
+	}
+	server := &http.Server{Handler: auth.handler(audit.handler(handler)), TLSConfig: auth.tlsConfig()}
+	fmt.Printf("Admin API listening on %v\n", admin_url(admin_listener, admin_conf.TLSCert != ""))
+	if admin_conf.TLSCert != "" {
+		err = server.ServeTLS(admin_listener, admin_conf.TLSCert, admin_conf.TLSKey)
+	} else {
+		err = server.Serve(admin_listener)
+	}
+	gou.Errorf("Admin API stopped. err=%v", err)
+	os.Exit(1)
+}
+
+//getWrite registers a v1 GET route that changes the state of the proxy. See mutating.
+func getWrite(app *macaron.Macaron, pattern string, handlers ...macaron.Handler) {
+	writeRoutes[pattern] = true
+	app.Get(pattern, handlers...)
+}
+
+//registerV1 registers the v1 routes of the admin API, and the list of routes at /.
+func registerV1(app *macaron.Macaron) {
 	set_latency := func(_type string) func(ctx *macaron.Context) {
 		return func(ctx *macaron.Context) {
 			defer recover_asserts(ctx)
 			count := -1
 			_latency := ctx.Req.URL.Query().Get("latency")
 			_count := ctx.Req.URL.Query().Get("count")
-			assert(_latency != "", "latency param not set")
+			_failure_rate := ctx.Req.URL.Query().Get("failure_rate")
+			assert(_latency != "" || _failure_rate != "", "latency param not set")
 			if _count != "" {
 				if i, err := strconv.ParseInt(_count, 10, 64); err == nil {
 					count = int(i)
 				}
 
 			}
-			latency, err := time.ParseDuration(_latency)
-			assertErr(err, "")
+			latency := time.Duration(0)
+			if _latency != "" {
+				var err error
+				latency, err = time.ParseDuration(_latency)
+				assertErr(err, "")
+			}
+			rule := dsp.LatencyAndCountStruct{Latency: latency, Count: count}
+			if _failure_rate != "" {
+				var err error
+				rule.FailureRate, err = strconv.ParseFloat(_failure_rate, 64)
+				assertErr(err, "invalid failure_rate")
+			}
+
+			//optional ramp of latency and failure rate
+			ramp := dsp.Ramp{}
+			for param, d := range map[string]*time.Duration{"ramp_up": &ramp.Up, "hold": &ramp.Hold, "ramp_down": &ramp.Down} {
+				if v := ctx.Req.URL.Query().Get(param); v != "" {
+					var err error
+					*d, err = time.ParseDuration(v)
+					assertErr(err, "invalid "+param)
+					rule.Ramp = &ramp
+				}
+			}
+
+			//optional start delay and expiry, as a ttl from the start or an absolute end time
+			now := time.Now()
+			if _delay := ctx.Req.URL.Query().Get("delay"); _delay != "" {
+				delay, err := time.ParseDuration(_delay)
+				assertErr(err, "invalid delay")
+				rule.Start = now.Add(delay)
+			}
+			_ttl := ctx.Req.URL.Query().Get("ttl")
+			_until := ctx.Req.URL.Query().Get("until")
+			assert(_ttl == "" || _until == "", "ttl and until can't be used at the same time")
+			if _ttl != "" {
+				ttl, err := time.ParseDuration(_ttl)
+				assertErr(err, "invalid ttl")
+				rule.Expires = now.Add(ttl)
+				if !rule.Start.IsZero() {
+					rule.Expires = rule.Start.Add(ttl)
+				}
+			}
+			if _until != "" {
+				until, err := time.Parse(time.RFC3339, _until)
+				assertErr(err, "invalid until")
+				rule.Expires = until
+			}
 
 			host := ctx.Params("host")
-			ip, err := dsp.SetLatencyForHost(host, _type, latency, count)
+			ip, err := session(ctx).SetLatencyRuleForHost(host, _type, rule)
 			assertErr(err, "")
 
-			ctx.JSON(200, fmt.Sprintf("%v %v(%v) latency=%v. count=%v", _type, host, ip, latency.String(), count))
+			ctx.JSON(200, fmt.Sprintf("%v %v(%v) latency=%v. count=%v. failure_rate=%v. ramp=%v. start=%v. ttl=%v.", _type, host, ip, latency.String(), count, rule.FailureRate, ramp_string(rule), rule.Start, ttl(rule)))
 		}
 	}
 
 	get_latency := func(_type string) func(ctx *macaron.Context) {
 		return func(ctx *macaron.Context) {
+			defer recover_asserts(ctx)
 			host := ctx.Params("host")
-			ip, latencyAndCount, exists, err := dsp.GetLatencyForHost(host, _type)
+			ip, latencyAndCount, exists, err := session(ctx).GetLatencyForHost(host, _type)
 			assertErr(err, "")
-			ctx.JSON(200, fmt.Sprintf("%v %v(%v) latency=%v. count=%v. found=%v.", _type, host, ip, latencyAndCount.Latency, latencyAndCount.Count, exists))
+			latency, failure_rate := latencyAndCount.At(time.Now())
+			ctx.JSON(200, fmt.Sprintf("%v %v(%v) latency=%v. count=%v. failure_rate=%v. ramp=%v. current_latency=%v. current_failure_rate=%v. start=%v. ttl=%v. found=%v.", _type, host, ip, latencyAndCount.Latency, latencyAndCount.Count, latencyAndCount.FailureRate, ramp_string(latencyAndCount), latency, failure_rate, latencyAndCount.Start, ttl(latencyAndCount), exists))
 		}
 	}
 
-	app.Get("/whitelist/:host/:addorremove", func(ctx *macaron.Context) {
+	getWrite(app, "/whitelist/:host/:addorremove", func(ctx *macaron.Context) {
 		host := ctx.Params("host")
 		defer recover_asserts(ctx)
 
 		add := ctx.Params("addorremove") == "add"
-		ip, err := dsp.SetWhitelistForHost(host, add)
+		ip, err := session(ctx).SetWhitelistForHost(host, add)
 		assertErr(err, "")
 
 		if add {
@@ -127,19 +424,15 @@ func main() {
 		}
 	})
 	app.Get("/whitelisted", func(ctx *macaron.Context) {
-		var hosts []string
-		for host, _ := range dsp.HostToAllow {
-			hosts = append(hosts, host)
-		}
-		sort.Strings(hosts)
-		ctx.JSON(200, hosts)
+		defer recover_asserts(ctx)
+		ctx.JSON(200, rule_hosts(session(ctx), dsp.WHITELIST))
 	})
 
-	app.Get("/blacklist/:host/:addorremove", func(ctx *macaron.Context) {
+	getWrite(app, "/blacklist/:host/:addorremove", func(ctx *macaron.Context) {
 		host := ctx.Params("host")
 		defer recover_asserts(ctx)
-		add := ctx.Params("add_or_remove") == "add"
-		ip, err := dsp.SetBlacklistForHost(host, add)
+		add := ctx.Params("addorremove") == "add"
+		ip, err := session(ctx).SetBlacklistForHost(host, add)
 
 		assertErr(err, "")
 
@@ -150,37 +443,176 @@ func main() {
 		}
 	})
 	app.Get("/blacklisted", func(ctx *macaron.Context) {
-		var hosts []string
-		for host, _ := range dsp.HostToClose {
-			hosts = append(hosts, host)
-		}
-		sort.Strings(hosts)
-		ctx.JSON(200, hosts)
+		defer recover_asserts(ctx)
+		ctx.JSON(200, rule_hosts(session(ctx), dsp.BLACKLIST))
+	})
+
+	app.Get("/access", func(ctx *macaron.Context) {
+		mode := dsp.GetAccessMode()
+		ctx.JSON(200, fmt.Sprintf("mode=%v. precedence=%v.", mode.Mode, mode.Precedence))
+	})
+	getWrite(app, "/access/:mode", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		err := dsp.SetAccessMode(dsp.AccessMode{Mode: ctx.Params("mode"), Precedence: ctx.Req.URL.Query().Get("precedence")})
+		assertErr(err, "")
+		mode := dsp.GetAccessMode()
+		ctx.JSON(200, fmt.Sprintf("Switched access mode. mode=%v. precedence=%v.", mode.Mode, mode.Precedence))
 	})
 
-	app.Get("/set_latency/:host/"+dsp.PER_REMOTE_WRITE, set_latency(dsp.PER_REMOTE_WRITE))
-	app.Get("/set_latency/:host/"+dsp.PER_REMOTE_READ, set_latency(dsp.PER_REMOTE_READ))
-	app.Get("/set_latency/:host/"+dsp.PER_REMOTE_CONNECT, set_latency(dsp.PER_REMOTE_CONNECT))
+	getWrite(app, "/set_latency/:host/"+dsp.PER_REMOTE_WRITE, set_latency(dsp.PER_REMOTE_WRITE))
+	getWrite(app, "/set_latency/:host/"+dsp.PER_REMOTE_READ, set_latency(dsp.PER_REMOTE_READ))
+	getWrite(app, "/set_latency/:host/"+dsp.PER_REMOTE_CONNECT, set_latency(dsp.PER_REMOTE_CONNECT))
 
 	app.Get("/get_latancy/all/"+dsp.PER_REMOTE_CONNECT, func(ctx *macaron.Context) {
-		gou.Info(dsp.HostToSleepPerRemoteConnect)
-		ctx.JSON(200, dsp.HostToSleepPerRemoteConnect)
+		defer recover_asserts(ctx)
+		hostToSleep := rules_by_host(session(ctx), dsp.PER_REMOTE_CONNECT)
+		gou.Info(hostToSleep)
+		ctx.JSON(200, hostToSleep)
 	})
 	app.Get("/get_latancy/all/"+dsp.PER_REMOTE_WRITE, func(ctx *macaron.Context) {
-		gou.Info(dsp.HostToSleepPerRemoteWrite)
-		ctx.JSON(200, dsp.HostToSleepPerRemoteWrite)
+		defer recover_asserts(ctx)
+		hostToSleep := rules_by_host(session(ctx), dsp.PER_REMOTE_WRITE)
+		gou.Info(hostToSleep)
+		ctx.JSON(200, hostToSleep)
 	})
 
 	app.Get("/get_latancy/:host/"+dsp.PER_REMOTE_WRITE, get_latency(dsp.PER_REMOTE_WRITE))
 	app.Get("/get_latancy/:host/"+dsp.PER_REMOTE_CONNECT, get_latency(dsp.PER_REMOTE_CONNECT))
 
+	//all rules, in evaluation order
+	app.Get("/rules", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		ctx.JSON(200, session(ctx).ListRules())
+	})
+
+	//sessions
+	app.Get("/sessions", func(ctx *macaron.Context) {
+		ctx.JSON(200, dsp.SessionNames())
+	})
+	getWrite(app, "/session/:name/create", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		name := ctx.Params("name")
+		query := ctx.Req.URL.Query()
+		var sources []string
+		if query.Get("sources") != "" {
+			sources = strings.Split(query.Get("sources"), ",")
+		}
+		s, err := dsp.CreateSession(name, query.Get("username"), sources, query.Get("addr"))
+		assertErr(err, "")
+		ctx.JSON(200, s)
+	})
+	getWrite(app, "/session/:name/delete", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		name := ctx.Params("name")
+		assertErr(dsp.DeleteSession(name), "")
+		ctx.JSON(200, fmt.Sprintf("Deleted session %v.", name))
+	})
+	app.Get("/session/:name", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		s, err := dsp.GetSession(ctx.Params("name"))
+		assertErr(err, "")
+		ctx.JSON(200, map[string]interface{}{
+			"session": s,
+			"rules":   s.ListRules(),
+		})
+	})
+
+	//schedules
+	app.Get("/schedules", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		ctx.JSON(200, session(ctx).Schedules())
+	})
+	getWrite(app, "/schedule/:name/create", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		query := ctx.Req.URL.Query()
+		sc := dsp.Schedule{
+			Name: ctx.Params("name"),
+			Host: query.Get("host"),
+			Type: query.Get("type"),
+			Cron: query.Get("cron"),
+		}
+		var err error
+		if query.Get("latency") != "" {
+			sc.Latency, err = time.ParseDuration(query.Get("latency"))
+			assertErr(err, "invalid latency")
+		}
+		if query.Get("count") != "" {
+			sc.Count, err = strconv.Atoi(query.Get("count"))
+			assertErr(err, "invalid count")
+		}
+		assert(query.Get("duration") != "", "duration param not set")
+		sc.Duration, err = time.ParseDuration(query.Get("duration"))
+		assertErr(err, "invalid duration")
+		if query.Get("every") != "" {
+			sc.Every, err = time.ParseDuration(query.Get("every"))
+			assertErr(err, "invalid every")
+		}
+
+		assertErr(session(ctx).AddSchedule(sc), "")
+		ctx.JSON(200, fmt.Sprintf("Added schedule %v.", sc.Name))
+	})
+	getWrite(app, "/schedule/:name/delete", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		name := ctx.Params("name")
+		assertErr(session(ctx).RemoveSchedule(name), "")
+		ctx.JSON(200, fmt.Sprintf("Removed schedule %v.", name))
+	})
+
+	//scenarios
+	app.Post("/scenario/upload", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		data, err := ioutil.ReadAll(ctx.Req.Request.Body)
+		assertErr(err, "")
+		sc, err := dsp.UploadScenario(data)
+		assertErr(err, "")
+		ctx.JSON(200, fmt.Sprintf("Uploaded scenario %v with %v steps.", sc.Name, len(sc.Steps)))
+	})
+	app.Get("/scenarios", func(ctx *macaron.Context) {
+		ctx.JSON(200, dsp.ListScenarios())
+	})
+	app.Get("/scenario/:name", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		status, err := dsp.GetScenario(ctx.Params("name"))
+		assertErr(err, "")
+		ctx.JSON(200, status)
+	})
+	scenario_action := func(action func(string) error, done string) func(ctx *macaron.Context) {
+		return func(ctx *macaron.Context) {
+			defer recover_asserts(ctx)
+			name := ctx.Params("name")
+			assertErr(action(name), "")
+			ctx.JSON(200, fmt.Sprintf("%v scenario %v.", done, name))
+		}
+	}
+	getWrite(app, "/scenario/:name/start", scenario_action(dsp.StartScenario, "Started"))
+	getWrite(app, "/scenario/:name/pause", scenario_action(dsp.PauseScenario, "Paused"))
+	getWrite(app, "/scenario/:name/abort", scenario_action(dsp.AbortScenario, "Aborted"))
+
+	//listeners
+	app.Get("/listeners", func(ctx *macaron.Context) {
+		ctx.JSON(200, dsp.Listeners())
+	})
+	getWrite(app, "/listener/:name/create", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		s, err := dsp.CreateListener(ctx.Params("name"), ctx.Req.URL.Query().Get("addr"))
+		assertErr(err, "")
+		ctx.JSON(200, s)
+	})
+	getWrite(app, "/listener/:name/delete", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		name := ctx.Params("name")
+		assertErr(dsp.DeleteListener(name), "")
+		ctx.JSON(200, fmt.Sprintf("Closed listener %v.", name))
+	})
+
 	//metrics
+	app.Get("/connections", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		ctx.JSON(200, session(ctx).Connections())
+	})
 	app.Get("/counters", func(ctx *macaron.Context) {
-		var _counters map[string]float64
-		dsp.RW_Locker(dsp.CountersSync, func() {
-			_counters = dsp.Counters
-		})
-		ctx.JSON(200, _counters)
+		defer recover_asserts(ctx)
+		ctx.JSON(200, session(ctx).Counters())
 	})
 
 	app.Get("/dependencies", func(ctx *macaron.Context) {
@@ -196,10 +628,9 @@ func main() {
 	})
 
 	//metrics
-	app.Get("/counters/reset", func(ctx *macaron.Context) {
-		dsp.RW_Locker(dsp.CountersSync, func() {
-			dsp.Counters = make(map[string]float64)
-		})
+	getWrite(app, "/counters/reset", func(ctx *macaron.Context) {
+		defer recover_asserts(ctx)
+		session(ctx).ResetCounters()
 		ctx.JSON(200, "reset counters")
 	})
 	app.Get("/", func(ctx *macaron.Context) {
@@ -208,18 +639,55 @@ func main() {
 			"/blacklist/:host/:add_or_remove",
 			"/whitelisted",
 			"/blacklisted",
-			"/set_latency/:host/" + dsp.PER_REMOTE_WRITE + "?latency=100ms[&count=1]",
-			"/set_latency/:host/" + dsp.PER_REMOTE_READ + "?latency=100ms[&count=1]",
-			"/set_latency/:host/" + dsp.PER_REMOTE_CONNECT + "?latency=100ms[&count=1]",
+			"/access",
+			"/access/:open_blacklist_whitelist_or_combined[?precedence=deny|allow]",
+			"/set_latency/:host/" + dsp.PER_REMOTE_WRITE + "?latency=100ms[&count=1][&failure_rate=0.1][&delay=10s][&ttl=30m|&until=2016-01-02T15:04:05Z][&ramp_up=10m][&hold=1m][&ramp_down=10m]",
+			"/set_latency/:host/" + dsp.PER_REMOTE_READ + "?latency=100ms[&count=1][&failure_rate=0.1][&delay=10s][&ttl=30m|&until=2016-01-02T15:04:05Z][&ramp_up=10m][&hold=1m][&ramp_down=10m]",
+			"/set_latency/:host/" + dsp.PER_REMOTE_CONNECT + "?latency=100ms[&count=1][&failure_rate=0.1][&delay=10s][&ttl=30m|&until=2016-01-02T15:04:05Z][&ramp_up=10m][&hold=1m][&ramp_down=10m]",
 			"/get_latancy/:host/" + dsp.PER_REMOTE_WRITE,
 			"/get_latancy/:host/" + dsp.PER_REMOTE_CONNECT,
 			"/get_latancy/all/" + dsp.PER_REMOTE_WRITE,
 			"/get_latancy/all/" + dsp.PER_REMOTE_CONNECT,
+			"/rules",
+			"/connections",
 			"/counters",
 			"/counters/reset",
 			"/dependencies",
+			"/sessions",
+			"/session/:name/create?[username=ci-1][&sources=10.0.0.0/8,127.0.0.1][&addr=0.0.0.0:9001]",
+			"/session/:name",
+			"/session/:name/delete",
+			"/schedules",
+			"/schedule/:name/create?host=payments&type=" + dsp.BLACKLIST + "&duration=30s&every=5m",
+			"/schedule/:name/create?host=payments&type=" + dsp.PER_REMOTE_WRITE + "&latency=2s[&count=1]&duration=30s&cron=*/5 9-17 * * 1-5",
+			"/schedule/:name/delete",
+			"POST /scenario/upload",
+			"/scenarios",
+			"/scenario/:name",
+			"/scenario/:name/start",
+			"/scenario/:name/pause",
+			"/scenario/:name/abort",
+			"/listeners",
+			"/listener/:name/create?addr=0.0.0.0:9001",
+			"/listener/:name/delete",
+			"GET /v2/openapi.json",
+			"GET|POST /v2/sessions",
+			"GET|DELETE /v2/sessions/:session",
+			"GET|POST /v2/sessions/:session/rules",
+			"GET|PUT|DELETE /v2/sessions/:session/rules/:id",
+			"GET /v2/sessions/:session/connections",
+			"GET|DELETE /v2/sessions/:session/counters",
+			"GET|POST /v2/sessions/:session/schedules",
+			"GET|DELETE /v2/sessions/:session/schedules/:name",
+			"GET|POST /v2/scenarios",
+			"GET /v2/scenarios/:name",
+			"POST /v2/scenarios/:name/start|pause|abort",
+			"GET|POST /v2/listeners",
+			"DELETE /v2/listeners/:name",
+			"GET|PUT /v2/state",
+			"GET|PUT /v2/access",
+			"GET /state/export",
+			"POST /state/import",
 		})
 	})
-
-	app.Run()
 }
@@ -0,0 +1,42 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Unknwon/macaron"
+	dsp "github.com/intuit/destructive_socks5_proxy"
+)
+
+func TestV1Blacklist(t *testing.T) {
+	app := macaron.New()
+	app.Use(macaron.Renderer())
+	registerV1(app)
+	admin := httptest.NewServer(app)
+	defer admin.Close()
+
+	for _, action := range []string{"add", "remove"} {
+		resp, err := http.Get(admin.URL + "/blacklist/10.0.0.7/" + action)
+		if err != nil {
+			t.Fatal("got error", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatal("unexpected status", resp.Status)
+		}
+		hosts := rule_hosts(dsp.DefaultSession, dsp.BLACKLIST)
+		if action == "add" && (len(hosts) != 1 || hosts[0] != "10.0.0.7") {
+			t.Error("expected the host to be blacklisted", hosts)
+		}
+		if action == "remove" && len(hosts) != 0 {
+			t.Error("expected the host to be removed from the blacklist", hosts)
+		}
+	}
+}
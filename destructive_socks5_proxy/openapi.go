@@ -0,0 +1,441 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+//OpenAPI document of the v2 admin API, served at /v2/openapi.json.
+const openapi = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Destructive Proxy admin API",
+    "version": "2.0.0",
+    "description": "Manage the sessions, fault rules, schedules, scenarios, listeners, state and counters of the destructive proxy. Durations are duration strings such as 100ms, 30s or 1m."
+  },
+  "paths": {
+    "/v2/sessions": {
+      "get": {
+        "summary": "List sessions, including the default session",
+        "responses": {
+          "200": {"description": "Sessions", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Session"}}}}}
+        }
+      },
+      "post": {
+        "summary": "Create a session",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Session"}}}},
+        "responses": {
+          "201": {"description": "Created session", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Session"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/sessions/{session}": {
+      "parameters": [{"$ref": "#/components/parameters/session"}],
+      "get": {
+        "summary": "Get a session",
+        "responses": {
+          "200": {"description": "Session", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Session"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a session with all of its rules, and close its dedicated listener",
+        "responses": {
+          "204": {"description": "Deleted"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/sessions/{session}/rules": {
+      "parameters": [{"$ref": "#/components/parameters/session"}],
+      "get": {
+        "summary": "List the rules of a session in evaluation order",
+        "responses": {
+          "200": {"description": "Rules", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Rule"}}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Set a rule, replacing a rule of the same type for the same host in its place",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Rule"}}}},
+        "responses": {
+          "201": {"description": "Rule", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Rule"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/sessions/{session}/rules/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/session"}, {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {
+        "summary": "Get a rule",
+        "responses": {
+          "200": {"description": "Rule", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Rule"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Replace a rule. Its type can't change.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Rule"}}}},
+        "responses": {
+          "200": {"description": "Rule", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Rule"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Remove a rule",
+        "responses": {
+          "204": {"description": "Removed"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/sessions/{session}/connections": {
+      "parameters": [{"$ref": "#/components/parameters/session"}],
+      "get": {
+        "summary": "List the active connections of a session, oldest first",
+        "responses": {
+          "200": {"description": "Connections", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Connection"}}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/sessions/{session}/counters": {
+      "parameters": [{"$ref": "#/components/parameters/session"}],
+      "get": {
+        "summary": "Get the counters of a session. The counters of the default session are the counters of the whole process.",
+        "responses": {
+          "200": {"description": "Counters", "content": {"application/json": {"schema": {"type": "object", "additionalProperties": {"type": "number"}}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Reset the counters of a session",
+        "responses": {
+          "204": {"description": "Reset"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/sessions/{session}/schedules": {
+      "parameters": [{"$ref": "#/components/parameters/session"}],
+      "get": {
+        "summary": "List the schedules of a session, sorted by name",
+        "responses": {
+          "200": {"description": "Schedules", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Schedule"}}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Add a schedule, which applies its rule at the start of every window and lets it expire at its end",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Schedule"}}}},
+        "responses": {
+          "201": {"description": "Schedule", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Schedule"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/sessions/{session}/schedules/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/session"}, {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {
+        "summary": "Get a schedule",
+        "responses": {
+          "200": {"description": "Schedule", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Schedule"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Remove a schedule. A window that is in progress runs to its end.",
+        "responses": {
+          "204": {"description": "Removed"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/scenarios": {
+      "get": {
+        "summary": "List scenarios and their progress, sorted by name",
+        "responses": {
+          "200": {"description": "Scenarios", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Scenario"}}}}}
+        }
+      },
+      "post": {
+        "summary": "Upload a scenario, replacing a scenario of the same name that isn't running or paused",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Scenario"}}}},
+        "responses": {
+          "201": {"description": "Scenario", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Scenario"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/scenarios/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/scenario"}],
+      "get": {
+        "summary": "Get a scenario and its progress",
+        "responses": {
+          "200": {"description": "Scenario", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Scenario"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/scenarios/{name}/start": {
+      "parameters": [{"$ref": "#/components/parameters/scenario"}],
+      "post": {
+        "summary": "Start a scenario from its first step, or resume a paused one",
+        "responses": {
+          "200": {"description": "Scenario", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Scenario"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/scenarios/{name}/pause": {
+      "parameters": [{"$ref": "#/components/parameters/scenario"}],
+      "post": {
+        "summary": "Pause a running scenario. Waits and timeouts stop counting while paused.",
+        "responses": {
+          "200": {"description": "Scenario", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Scenario"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/scenarios/{name}/abort": {
+      "parameters": [{"$ref": "#/components/parameters/scenario"}],
+      "post": {
+        "summary": "Abort a running or paused scenario. Rules it applied are left in place.",
+        "responses": {
+          "200": {"description": "Scenario", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Scenario"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/listeners": {
+      "get": {
+        "summary": "List the sessions that have a dedicated listener, sorted by name",
+        "responses": {
+          "200": {"description": "Listeners", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Listener"}}}}}
+        }
+      },
+      "post": {
+        "summary": "Create a session with a dedicated listener",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Listener"}}}},
+        "responses": {
+          "201": {"description": "Listener", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Listener"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/listeners/{name}": {
+      "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "delete": {
+        "summary": "Close a listener and delete its session",
+        "responses": {
+          "204": {"description": "Deleted"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/state": {
+      "get": {
+        "summary": "Export the fault state, in the format of the -config file",
+        "responses": {
+          "200": {"description": "State", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/State"}}}}
+        }
+      },
+      "put": {
+        "summary": "Replace the fault state. Sessions that aren't in the state are deleted. An import that fails changes nothing.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/State"}}}},
+        "responses": {
+          "200": {"description": "Imported state", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/State"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/access": {
+      "get": {
+        "summary": "Get the access mode of the proxy, which of the blacklist and whitelist rules apply",
+        "responses": {
+          "200": {"description": "Access mode", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Access"}}}}
+        }
+      },
+      "put": {
+        "summary": "Switch the access mode of the proxy. Blacklist and whitelist rules are kept in every mode.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Access"}}}},
+        "responses": {
+          "200": {"description": "Access mode", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Access"}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "session": {"name": "session", "in": "path", "required": true, "description": "Session name, default for the default session", "schema": {"type": "string"}},
+      "scenario": {"name": "name", "in": "path", "required": true, "description": "Scenario name", "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {
+          "error": {
+            "type": "object",
+            "required": ["code", "message"],
+            "properties": {
+              "code": {"type": "string", "enum": ["invalid_request", "not_found", "conflict", "internal_error"], "description": "internal_error is a failure of the proxy, e.g. a listener address in use"},
+              "message": {"type": "string"}
+            }
+          }
+        }
+      },
+      "Session": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {
+          "name": {"type": "string"},
+          "username": {"type": "string", "description": "SOCKS5 username of the connections of the session"},
+          "sources": {"type": "array", "items": {"type": "string"}, "description": "Source ips or cidrs of the connections of the session"},
+          "addr": {"type": "string", "description": "Address of a listener dedicated to the session: host:port for SOCKS, http://host:port for an HTTP proxy, or listen->target for a port forward"},
+          "created": {"type": "string", "format": "date-time", "readOnly": true}
+        }
+      },
+      "Connection": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "session": {"type": "string"},
+          "client": {"type": "string", "description": "Address of the client"},
+          "remote": {"type": "string", "description": "host:port requested by the client"},
+          "started": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Access": {
+        "type": "object",
+        "required": ["mode"],
+        "properties": {
+          "mode": {"type": "string", "enum": ["open", "blacklist", "whitelist", "combined"], "description": "open allows every host, blacklist denies blacklisted hosts, whitelist only allows whitelisted hosts, and combined applies both lists"},
+          "precedence": {"type": "string", "enum": ["deny", "allow"], "default": "deny", "description": "Of the combined mode. With deny, only whitelisted hosts that aren't blacklisted are allowed. With allow, whitelisted hosts are allowed, other blacklisted hosts denied, and hosts in neither list allowed."}
+        }
+      },
+      "Ramp": {
+        "type": "object",
+        "required": ["up"],
+        "properties": {
+          "up": {"type": "string", "description": "Duration to raise latency and failure rate from 0"},
+          "hold": {"type": "string", "description": "Duration to keep them at their full value"},
+          "down": {"type": "string", "description": "Duration to lower them back to 0, after which the rule is removed"}
+        }
+      },
+      "Schedule": {
+        "type": "object",
+        "required": ["name", "host", "type", "duration"],
+        "properties": {
+          "name": {"type": "string"},
+          "host": {"type": "string", "description": "Host name, ip, cidr, or * for any host"},
+          "type": {"type": "string", "enum": ["per_remote_write", "per_remote_read", "per_remote_connect", "blacklist"]},
+          "latency": {"type": "string", "description": "Of latency schedules"},
+          "count": {"type": "integer", "default": -1, "description": "Number of times to apply the rule in each window, < 0 for no limit"},
+          "duration": {"type": "string", "description": "Length of each window, shorter than the time between windows"},
+          "every": {"type": "string", "description": "Interval between windows, from the creation of the schedule. Exclusive with cron."},
+          "cron": {"type": "string", "description": "Cron expression of the start of the windows: minute hour day-of-month month day-of-week"},
+          "next": {"type": "string", "format": "date-time", "readOnly": true, "description": "Start of the next window"}
+        }
+      },
+      "ScenarioStep": {
+        "type": "object",
+        "required": ["action"],
+        "properties": {
+          "action": {"type": "string", "enum": ["set_latency", "clear_latency", "blacklist_add", "blacklist_remove", "whitelist_add", "whitelist_remove", "wait", "assert"]},
+          "host": {"type": "string", "description": "Of the rule steps"},
+          "type": {"type": "string", "enum": ["per_remote_write", "per_remote_read", "per_remote_connect"], "description": "Of set_latency and clear_latency"},
+          "latency": {"type": "string", "description": "Of set_latency"},
+          "count": {"type": "integer", "description": "Of set_latency, no limit if not set"},
+          "duration": {"type": "string", "description": "Of wait"},
+          "counter": {"type": "string", "description": "Of assert, 0 if not counted yet"},
+          "op": {"type": "string", "enum": ["==", "!=", "<", "<=", ">", ">="], "description": "Of assert"},
+          "value": {"type": "number", "description": "Of assert"},
+          "timeout": {"type": "string", "description": "Of assert, to poll until the assert holds"}
+        }
+      },
+      "Scenario": {
+        "type": "object",
+        "required": ["name", "steps"],
+        "properties": {
+          "name": {"type": "string"},
+          "session": {"type": "string", "description": "Session the steps apply to, the default session if not set"},
+          "steps": {"type": "array", "items": {"$ref": "#/components/schemas/ScenarioStep"}},
+          "state": {"type": "string", "enum": ["ready", "running", "paused", "aborted", "failed", "completed"], "readOnly": true},
+          "step": {"type": "integer", "readOnly": true, "description": "Index of the step being run"},
+          "error": {"type": "string", "readOnly": true, "description": "Why the scenario failed"},
+          "started": {"type": "string", "format": "date-time", "readOnly": true},
+          "finished": {"type": "string", "format": "date-time", "readOnly": true}
+        }
+      },
+      "Listener": {
+        "type": "object",
+        "required": ["name", "addr"],
+        "properties": {
+          "name": {"type": "string", "description": "Name of the session of the listener"},
+          "addr": {"type": "string", "description": "host:port for SOCKS, http://host:port for an HTTP proxy, or listen->target for a port forward. In responses, the bound address."}
+        }
+      },
+      "State": {
+        "type": "object",
+        "properties": {
+          "blacklist": {"type": "boolean", "description": "Whether blacklist rules apply"},
+          "whitelist": {"type": "boolean", "description": "Whether whitelist rules apply"},
+          "precedence": {"type": "string", "enum": ["deny", "allow"], "description": "Of the combined mode, when both apply"},
+          "rules": {"type": "array", "items": {"$ref": "#/components/schemas/Rule"}, "description": "Rules of the default session"},
+          "sessions": {
+            "type": "array",
+            "items": {
+              "allOf": [
+                {"$ref": "#/components/schemas/Session"},
+                {"type": "object", "properties": {"rules": {"type": "array", "items": {"$ref": "#/components/schemas/Rule"}}}}
+              ]
+            },
+            "description": "Other sessions. The addr of existing sessions is left as is."
+          }
+        }
+      },
+      "Rule": {
+        "type": "object",
+        "required": ["type", "host"],
+        "properties": {
+          "id": {"type": "string", "readOnly": true, "description": "Stays the same for as long as the session has a rule of this type for this host"},
+          "type": {"type": "string", "enum": ["per_remote_write", "per_remote_read", "per_remote_connect", "per_remote_udp", "blacklist", "whitelist"]},
+          "host": {"type": "string", "description": "Host name, ip, cidr, or * for any host"},
+          "match": {"type": "string", "readOnly": true, "description": "Ip or cidr the host resolved to"},
+          "priority": {"type": "integer", "default": 0, "description": "Rules with a higher priority are evaluated first. Rules of the same priority are evaluated in the order they were set; the first active rule that matches applies."},
+          "latency": {"type": "string"},
+          "count": {"type": "integer", "default": -1, "description": "Number of times to apply the rule, < 0 for no limit"},
+          "failure_rate": {"type": "number", "minimum": 0, "maximum": 1, "description": "Probability of closing the connection each time the rule applies, or of dropping the datagram for per_remote_udp rules"},
+          "start": {"type": "string", "format": "date-time"},
+          "expires": {"type": "string", "format": "date-time"},
+          "ttl": {"type": "string", "description": "In requests, the duration from start until the rule expires. In responses, the time left."},
+          "ramp": {"$ref": "#/components/schemas/Ramp"},
+          "duplicate_rate": {"type": "number", "minimum": 0, "maximum": 1, "description": "Of per_remote_udp rules, probability of sending a datagram twice"},
+          "reorder_rate": {"type": "number", "minimum": 0, "maximum": 1, "description": "Of per_remote_udp rules, probability of holding a datagram back until after the next one"},
+          "truncate": {"type": "integer", "minimum": 0, "description": "Of per_remote_udp rules, size in bytes the data of longer datagrams is cut to"}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,104 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/araddon/gou"
+	dsp "github.com/intuit/destructive_socks5_proxy"
+)
+
+//statePersister saves the fault state to a file, in the format of the config
+//file, after every change made through the admin API. Rules also change on their
+//own when they count down or expire, so the state is saved every interval too.
+type statePersister struct {
+	path string
+	sync sync.Mutex
+	last []byte //last saved state
+}
+
+//restore imports the state saved in the file, and returns false if there is none.
+func (p *statePersister) restore() (bool, error) {
+	conf, err := loadConfig(p.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	state, err := conf.toState()
+	if err != nil {
+		return false, err
+	}
+	return true, dsp.ImportState(state)
+}
+
+//save writes the state to the file, unless it didn't change since the last save.
+//The file is replaced atomically so a crash leaves the previous state.
+func (p *statePersister) save() error {
+	p.sync.Lock()
+	defer p.sync.Unlock()
+	data, err := json.MarshalIndent(config{stateConfig: toStateConfig(dsp.ExportState())}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, p.last) {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p.path); err != nil {
+		return err
+	}
+	p.last = data
+	return nil
+}
+
+func (p *statePersister) saveOrLog() {
+	if err := p.save(); err != nil {
+		gou.Errorf("Failed to save the state to %v. err=%v", p.path, err)
+	}
+}
+
+func (p *statePersister) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		p.saveOrLog()
+	}
+}
+
+//handler saves the state after the mutating requests to next.
+func (p *statePersister) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if mutating(r) {
+			p.saveOrLog()
+		}
+	})
+}
@@ -0,0 +1,44 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/Unknwon/macaron"
+	dsp "github.com/intuit/destructive_socks5_proxy"
+)
+
+func exportState(ctx *macaron.Context) (int, interface{}, error) {
+	return 200, toStateConfig(dsp.ExportState()), nil
+}
+
+func importState(ctx *macaron.Context) (int, interface{}, error) {
+	var conf config
+	if err := decode(ctx, &conf); err != nil {
+		return 0, nil, err
+	}
+	if conf.Admin != nil {
+		return 0, nil, fmt.Errorf("admin settings can't be imported, only set in the config file")
+	}
+	state, err := conf.toState()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := dsp.ImportState(state); err != nil {
+		return 0, nil, err
+	}
+	return 200, toStateConfig(dsp.ExportState()), nil
+}
+
+func registerState(app *macaron.Macaron) {
+	app.Get("/state/export", v2(exportState))
+	app.Post("/state/import", v2(importState))
+
+	app.Get("/v2/state", v2(exportState))
+	app.Put("/v2/state", v2(importState))
+}
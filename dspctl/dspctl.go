@@ -0,0 +1,505 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+//dspctl sets rules and reads the counters and connections of a running proxy
+//through its admin API.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/intuit/destructive_socks5_proxy/client"
+)
+
+const usage = `Usage: dspctl [-admin url] [-session name] [-token token] [-cert file -key file] [-ca file] <command> [arguments]
+
+Commands:
+  latency set <host> [-write d] [-read d] [-connect d] [-count n] [-failure-rate f] [-ttl d]
+  latency clear <host>
+  latency list
+  udp set <host> [-delay d] [-drop f] [-duplicate f] [-reorder f] [-truncate n] [-count n] [-ttl d]
+  udp clear <host>
+  udp list
+  blacklist add|remove <host>
+  blacklist list
+  whitelist add|remove <host>
+  whitelist list
+  access [open|blacklist|whitelist|combined] [-precedence deny|allow]
+  rules [list]
+  rules delete <id>
+  rules clear
+  counters [-watch] [-interval d] [-filter substring] [-reset]
+  connections
+  sessions
+  state export [file]
+  state import <file>
+
+<host> can be a host name, an ip, a cidr or * for any host.
+-admin defaults to $DSP_ADMIN_URL, or http://localhost:4000, and -token to $DSP_ADMIN_TOKEN.
+`
+
+var latencyTypes = []string{client.PER_REMOTE_WRITE, client.PER_REMOTE_READ, client.PER_REMOTE_CONNECT}
+
+func main() {
+	flags := flag.NewFlagSet("dspctl", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	default_admin := os.Getenv("DSP_ADMIN_URL")
+	if default_admin == "" {
+		default_admin = "http://localhost:4000"
+	}
+	admin := flags.String("admin", default_admin, "url of the admin API, or unix:/path/to/socket")
+	session := flags.String("session", "", "session to use, the default session if empty")
+	token := flags.String("token", client.Default.Token, "bearer token of the admin API")
+	cert := flags.String("cert", "", "client certificate file")
+	key := flags.String("key", "", "key file of -cert")
+	ca := flags.String("ca", "", "CA file of the admin API's certificate, the system CAs if empty")
+	flags.Parse(os.Args[1:])
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	c := client.New(strings.TrimRight(*admin, "/")).ForSession(*session)
+	c.Token = *token
+	if *cert != "" || *ca != "" {
+		conf, err := tlsConfig(*cert, *key, *ca)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dspctl: %v\n", err)
+			os.Exit(2)
+		}
+		useTLS(c, conf)
+	}
+	args := flags.Args()
+	var err error
+	switch args[0] {
+	case "latency":
+		err = latency(c, args[1:])
+	case "udp":
+		err = udp(c, args[1:])
+	case "blacklist":
+		err = list(c, client.BLACKLIST, args[1:])
+	case "whitelist":
+		err = list(c, client.WHITELIST, args[1:])
+	case "access":
+		err = access(c, args[1:])
+	case "rules":
+		err = rules(c, args[1:])
+	case "counters":
+		err = counters(c, args[1:])
+	case "connections":
+		err = connections(c)
+	case "sessions":
+		err = sessions(c)
+	case "state":
+		err = state(c, args[1:])
+	case "help":
+		flags.Usage()
+	default:
+		err = usageErrorf("unknown command %v", args[0])
+	}
+
+	if _, ok := err.(usageError); ok {
+		fmt.Fprintf(os.Stderr, "dspctl: %v\n\n%v", err, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dspctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func tlsConfig(cert, key, ca string) (*tls.Config, error) {
+	conf := &tls.Config{}
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %v", ca)
+		}
+	}
+	return conf, nil
+}
+
+//useTLS sets conf on the transport of c, keeping its dialer, e.g. of a unix socket.
+func useTLS(c *client.Client, conf *tls.Config) {
+	transport, ok := c.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		c.HTTPClient.Transport = transport
+	}
+	transport.TLSClientConfig = conf
+	if c.BaseURL == "http://unix" {
+		c.BaseURL = "https://unix"
+	}
+}
+
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+func usageErrorf(format string, args ...interface{}) error {
+	return usageError(fmt.Sprintf(format, args...))
+}
+
+//parse parses flags that come before, after or between the positional arguments,
+//e.g. `set db.internal -write 200ms`, and returns the positional arguments.
+func parse(flags *flag.FlagSet, args []string) ([]string, error) {
+	flags.Usage = func() {}
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, usageError(err.Error())
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func latency(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("latency", flag.ContinueOnError)
+	write := flags.Duration("write", 0, "latency added to every write to the host")
+	read := flags.Duration("read", 0, "latency added to every read from the host")
+	connect := flags.Duration("connect", 0, "latency added to every connect to the host")
+	count := flags.Int("count", client.NO_LIMIT, "number of times the latency applies, no limit if < 0")
+	failure_rate := flags.Float64("failure-rate", 0, "fraction of matches that close the connection instead, from 0 to 1")
+	ttl := flags.Duration("ttl", 0, "time after which the rule expires, never if 0")
+	positional, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return usageErrorf("latency needs set, clear or list")
+	}
+
+	switch {
+	case positional[0] == "list" && len(positional) == 1:
+		return printRules(c, latencyTypes...)
+	case positional[0] == "clear" && len(positional) == 2:
+		return removeRules(c, positional[1], latencyTypes...)
+	case positional[0] == "set" && len(positional) == 2:
+		latencies := []time.Duration{*write, *read, *connect}
+		if *write == 0 && *read == 0 && *connect == 0 {
+			if *failure_rate == 0 {
+				return usageErrorf("latency set needs -write, -read, -connect or -failure-rate")
+			}
+			latencies[0] = -1 //a failure rate alone applies to writes
+		}
+		for i, d := range latencies {
+			if d == 0 {
+				continue
+			}
+			if d < 0 {
+				d = 0
+			}
+			rule, err := c.SetRule(client.Rule{Type: latencyTypes[i], Host: positional[1], Latency: d, Count: *count, FailureRate: *failure_rate, TTL: *ttl})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("set %v %v\n", rule.ID, describe(rule))
+		}
+		return nil
+	}
+	return usageErrorf("unexpected latency arguments %v", strings.Join(positional, " "))
+}
+
+func udp(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("udp", flag.ContinueOnError)
+	delay := flags.Duration("delay", 0, "latency added to every datagram to and from the host")
+	drop := flags.Float64("drop", 0, "fraction of datagrams dropped, from 0 to 1")
+	duplicate := flags.Float64("duplicate", 0, "fraction of datagrams sent twice, from 0 to 1")
+	reorder := flags.Float64("reorder", 0, "fraction of datagrams sent after the next one, from 0 to 1")
+	truncate := flags.Int("truncate", 0, "size in bytes longer datagrams are cut to, none if 0")
+	count := flags.Int("count", client.NO_LIMIT, "number of datagrams the faults apply to, no limit if < 0")
+	ttl := flags.Duration("ttl", 0, "time after which the rule expires, never if 0")
+	positional, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return usageErrorf("udp needs set, clear or list")
+	}
+
+	switch {
+	case positional[0] == "list" && len(positional) == 1:
+		return printRules(c, client.PER_REMOTE_UDP)
+	case positional[0] == "clear" && len(positional) == 2:
+		return removeRules(c, positional[1], client.PER_REMOTE_UDP)
+	case positional[0] == "set" && len(positional) == 2:
+		rule, err := c.SetRule(client.Rule{Type: client.PER_REMOTE_UDP, Host: positional[1], Latency: *delay, Count: *count, FailureRate: *drop,
+			DuplicateRate: *duplicate, ReorderRate: *reorder, Truncate: *truncate, TTL: *ttl})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("set %v %v\n", rule.ID, describe(rule))
+		return nil
+	}
+	return usageErrorf("unexpected udp arguments %v", strings.Join(positional, " "))
+}
+
+func list(c *client.Client, _type string, args []string) error {
+	positional, err := parse(flag.NewFlagSet(_type, flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(positional) == 1 && positional[0] == "list":
+		return printRules(c, _type)
+	case len(positional) == 2 && positional[0] == "add":
+		rule, err := c.SetRule(client.Rule{Type: _type, Host: positional[1], Count: client.NO_LIMIT})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("added %v %v\n", rule.ID, describe(rule))
+		return nil
+	case len(positional) == 2 && positional[0] == "remove":
+		return removeRules(c, positional[1], _type)
+	}
+	return usageErrorf("%v needs add <host>, remove <host> or list", _type)
+}
+
+//access prints the access mode, after switching it if a mode is given.
+func access(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("access", flag.ContinueOnError)
+	precedence := flags.String("precedence", "", "deny or allow, which list wins in the combined mode")
+	positional, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	var mode client.Access
+	switch {
+	case len(positional) == 0 && *precedence == "":
+		mode, err = c.Access()
+	case len(positional) == 1:
+		mode, err = c.SetAccess(positional[0], *precedence)
+	default:
+		return usageErrorf("access needs open, blacklist, whitelist or combined")
+	}
+	if err != nil {
+		return err
+	}
+	if mode.Mode == client.MODE_COMBINED {
+		fmt.Printf("%v, %v precedence\n", mode.Mode, mode.Precedence)
+	} else {
+		fmt.Println(mode.Mode)
+	}
+	return nil
+}
+
+func rules(c *client.Client, args []string) error {
+	positional, err := parse(flag.NewFlagSet("rules", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(positional) == 0 || len(positional) == 1 && positional[0] == "list":
+		return printRules(c)
+	case len(positional) == 1 && positional[0] == "clear":
+		return c.ClearRules()
+	case len(positional) == 2 && positional[0] == "delete":
+		return c.DeleteRule(positional[1])
+	}
+	return usageErrorf("rules needs list, delete <id> or clear")
+}
+
+//removeRules removes the rules of the given types for host, as it was set or as it
+//resolved.
+func removeRules(c *client.Client, host string, types ...string) error {
+	rules, err := c.Rules()
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, rule := range rules {
+		if rule.Host != host && rule.Match != host || !contains(types, rule.Type) {
+			continue
+		}
+		if err := c.DeleteRule(rule.ID); err != nil && !client.IsNotFound(err) {
+			return err
+		}
+		fmt.Printf("removed %v %v\n", rule.ID, describe(rule))
+		removed++
+	}
+	if removed == 0 {
+		return fmt.Errorf("no %v rule for %v", strings.Join(types, " or "), host)
+	}
+	return nil
+}
+
+//printRules prints the rules of the given types, or all rules, in evaluation order.
+func printRules(c *client.Client, types ...string) error {
+	rules, err := c.Rules()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tHOST\tPRIORITY\tLATENCY\tCOUNT\tFAILURE RATE\tTTL")
+	for _, rule := range rules {
+		if len(types) > 0 && !contains(types, rule.Type) {
+			continue
+		}
+		count := "-"
+		if rule.Count == 0 {
+			count = "exhausted"
+		} else if rule.Count > 0 {
+			count = fmt.Sprint(rule.Count)
+		}
+		ttl := "-"
+		if !rule.Expires.IsZero() {
+			ttl = rule.TTL.String()
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", rule.ID, rule.Type, rule.Host, rule.Priority, rule.Latency, count, rule.FailureRate, ttl)
+	}
+	return w.Flush()
+}
+
+func describe(rule client.Rule) string {
+	s := fmt.Sprintf("%v %v", rule.Type, rule.Host)
+	if rule.Latency > 0 {
+		s += fmt.Sprintf(" latency=%v", rule.Latency)
+	}
+	if rule.Count >= 0 {
+		s += fmt.Sprintf(" count=%v", rule.Count)
+	}
+	if rule.FailureRate > 0 {
+		s += fmt.Sprintf(" failure_rate=%v", rule.FailureRate)
+	}
+	if rule.DuplicateRate > 0 {
+		s += fmt.Sprintf(" duplicate_rate=%v", rule.DuplicateRate)
+	}
+	if rule.ReorderRate > 0 {
+		s += fmt.Sprintf(" reorder_rate=%v", rule.ReorderRate)
+	}
+	if rule.Truncate > 0 {
+		s += fmt.Sprintf(" truncate=%v", rule.Truncate)
+	}
+	return s
+}
+
+func counters(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("counters", flag.ContinueOnError)
+	watch := flags.Bool("watch", false, "print the counters every -interval until interrupted")
+	interval := flags.Duration("interval", 2*time.Second, "interval of -watch")
+	filter := flags.String("filter", "", "only print the counters that contain this substring")
+	reset := flags.Bool("reset", false, "reset the counters")
+	positional, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return usageErrorf("unexpected counters arguments %v", strings.Join(positional, " "))
+	}
+	if *reset {
+		return c.ResetCounters()
+	}
+
+	for {
+		counters, err := c.Counters()
+		if err != nil {
+			return err
+		}
+		names := []string{}
+		for name := range counters {
+			if strings.Contains(name, *filter) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		if *watch {
+			fmt.Printf("--- %v\n", time.Now().Format(time.RFC3339))
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, name := range names {
+			fmt.Fprintf(w, "%v\t%v\n", name, counters[name])
+		}
+		w.Flush()
+		if !*watch {
+			return nil
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func connections(c *client.Client) error {
+	conns, err := c.Connections()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCLIENT\tREMOTE\tAGE")
+	for _, conn := range conns {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", conn.ID, conn.Client, conn.Remote, time.Since(conn.Started).Round(time.Second))
+	}
+	return w.Flush()
+}
+
+func sessions(c *client.Client) error {
+	sessions, err := c.Sessions()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tUSERNAME\tSOURCES\tADDR\tCREATED")
+	for _, s := range sessions {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", s.Name, s.Username, strings.Join(s.Sources, ","), s.Addr, s.Created.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//state exports the fault state to a file or stdout, or imports it from a file.
+func state(c *client.Client, args []string) error {
+	switch {
+	case len(args) >= 1 && len(args) <= 2 && args[0] == "export":
+		state, err := c.ExportState()
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 {
+			_, err = os.Stdout.Write(append(state, '\n'))
+			return err
+		}
+		return ioutil.WriteFile(args[1], append(state, '\n'), 0644)
+	case len(args) == 2 && args[0] == "import":
+		state, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		return c.ImportState(state)
+	}
+	return usageErrorf("state needs export [file] or import <file>")
+}
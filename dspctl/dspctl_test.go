@@ -0,0 +1,77 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/intuit/destructive_socks5_proxy/client"
+)
+
+func TestRemoveRulesByHostName(t *testing.T) {
+	deleted := []string{}
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			json.NewEncoder(w).Encode([]map[string]string{
+				{"id": "r1", "type": client.PER_REMOTE_WRITE, "host": "db.internal", "match": "10.0.0.5"},
+				{"id": "r2", "type": client.BLACKLIST, "host": "db.internal", "match": "10.0.0.5"},
+				{"id": "r3", "type": client.PER_REMOTE_READ, "host": "cache.internal", "match": "10.0.0.6"},
+			})
+		case "DELETE":
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(204)
+		}
+	}))
+	defer admin.Close()
+	c := client.New(admin.URL)
+
+	if err := removeRules(c, "db.internal", latencyTypes...); err != nil {
+		t.Fatal("got error", err)
+	}
+	if len(deleted) != 1 || deleted[0] != "/v2/sessions/default/rules/r1" {
+		t.Error("expected the latency rule of db.internal to be removed, got", deleted)
+	}
+	if err := removeRules(c, "10.0.0.6", latencyTypes...); err != nil || len(deleted) != 2 {
+		t.Error("expected the rule to be removed by its ip", deleted, err)
+	}
+	if err := removeRules(c, "other.internal", latencyTypes...); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+}
+
+func TestUseTLS(t *testing.T) {
+	conf := &tls.Config{ServerName: "dsp-admin"}
+	c := client.New("unix:/var/run/dsp-admin.sock")
+	useTLS(c, conf)
+	transport := c.HTTPClient.Transport.(*http.Transport)
+	if transport.DialContext == nil || transport.TLSClientConfig != conf || c.BaseURL != "https://unix" {
+		t.Error("expected TLS over the unix socket", c.BaseURL, transport)
+	}
+
+	c = client.New("https://localhost:4000")
+	useTLS(c, conf)
+	if c.HTTPClient.Transport.(*http.Transport).TLSClientConfig != conf || c.BaseURL != "https://localhost:4000" {
+		t.Error("expected TLS over tcp", c.BaseURL)
+	}
+}
+
+func TestDescribeCount(t *testing.T) {
+	if s := describe(client.Rule{Type: client.PER_REMOTE_WRITE, Host: "db", Count: 0}); s != "per_remote_write db count=0" {
+		t.Error("expected a used up rule to show its count", s)
+	}
+	if s := describe(client.Rule{Type: client.PER_REMOTE_WRITE, Host: "db", Count: 3}); s != "per_remote_write db count=3" {
+		t.Error("unexpected description", s)
+	}
+	if s := describe(client.Rule{Type: client.PER_REMOTE_WRITE, Host: "db", Count: client.NO_LIMIT}); s != "per_remote_write db" {
+		t.Error("expected no count for a rule with no limit", s)
+	}
+}
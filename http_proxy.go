@@ -0,0 +1,155 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/tawawhite/go-socks5"
+)
+
+//readHTTPRequest reads the request of an HTTP proxy client. A CONNECT request is
+//answered with 200 once the host is connected, and relayed like a SOCKS CONNECT.
+//An absolute-URI request, e.g. GET http://host/path, is relayed to its host in
+//origin form, with Connection: close as the connection is bound to that host. The
+//username of a Basic Proxy-Authorization picks the session, like a SOCKS5 username.
+func readHTTPRequest(conn net.Conn) (*request, error) {
+	r := bufio.NewReader(conn)
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	splt := strings.Split(line, " ")
+	if len(splt) != 3 || !strings.HasPrefix(splt[2], "HTTP/") {
+		writeHTTPReply(conn, http.StatusBadRequest)
+		return nil, fmt.Errorf("invalid http request line %q", line)
+	}
+	method, target, proto := splt[0], splt[1], splt[2]
+
+	req := &request{command: commandConnect, username: proxyUsername(header.Get("Proxy-Authorization")), conn: &bufferedConn{conn, r}}
+	if method == http.MethodConnect {
+		if req.addr, err = hostAddr(target, ""); err != nil {
+			writeHTTPReply(conn, http.StatusBadRequest)
+			return nil, err
+		}
+		req.reply = func(code byte, bound net.Addr) error {
+			if code == REPLY_SUCCEEDED {
+				_, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				return err
+			}
+			return writeHTTPReply(conn, httpStatus(code))
+		}
+		return req, nil
+	}
+
+	u, err := url.Parse(target)
+	if err == nil && u.Scheme != "http" {
+		err = fmt.Errorf("http proxy request for %q is not an absolute http uri", target)
+	}
+	if err == nil {
+		req.addr, err = hostAddr(u.Host, "80")
+	}
+	if err != nil {
+		writeHTTPReply(conn, http.StatusBadRequest)
+		return nil, err
+	}
+	header.Del("Proxy-Authorization")
+	header.Del("Proxy-Connection")
+	header.Set("Connection", "close")
+	if header.Get("Host") == "" {
+		header.Set("Host", u.Host)
+	}
+	head := &bytes.Buffer{}
+	fmt.Fprintf(head, "%v %v %v\r\n", method, u.RequestURI(), proto)
+	http.Header(header).Write(head)
+	head.WriteString("\r\n")
+	req.conn = &bufferedConn{conn, io.MultiReader(head, r)}
+	req.reply = func(code byte, bound net.Addr) error {
+		if code == REPLY_SUCCEEDED {
+			return nil //the response comes from the host
+		}
+		return writeHTTPReply(conn, httpStatus(code))
+	}
+	return req, nil
+}
+
+//hostAddr parses a host and optional port, defaultPort if not set.
+func hostAddr(hostport, defaultPort string) (*socks5.AddrSpec, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil && defaultPort != "" {
+		host, port, err = strings.Trim(hostport, "[]"), defaultPort, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	addr := &socks5.AddrSpec{FQDN: host}
+	if addr.Port, err = strconv.Atoi(port); err != nil || addr.Port <= 0 || addr.Port > 0xffff {
+		return nil, fmt.Errorf("invalid port in %q", hostport)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		addr.FQDN, addr.IP = "", ip
+	}
+	return addr, nil
+}
+
+//proxyUsername returns the username of a Basic Proxy-Authorization, if any.
+func proxyUsername(authorization string) string {
+	splt := strings.SplitN(authorization, " ", 2)
+	if len(splt) != 2 || !strings.EqualFold(splt[0], "Basic") {
+		return ""
+	}
+	credentials, err := base64.StdEncoding.DecodeString(strings.TrimSpace(splt[1]))
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(string(credentials), ":", 2)[0]
+}
+
+//httpStatus returns the HTTP status of a failed request for a SOCKS5 reply code.
+func httpStatus(code byte) int {
+	switch code {
+	case REPLY_NOT_ALLOWED:
+		return http.StatusForbidden
+	case REPLY_TTL_EXPIRED:
+		return http.StatusGatewayTimeout
+	case REPLY_COMMAND_NOT_SUPPORTED, REPLY_ADDRESS_NOT_SUPPORTED:
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+func writeHTTPReply(w io.Writer, status int) error {
+	body := http.StatusText(status) + "\n"
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %v %v\r\nContent-Type: text/plain\r\nContent-Length: %v\r\nConnection: close\r\n\r\n%v", status, http.StatusText(status), len(body), body)
+	return err
+}
+
+//A bufferedConn reads from r instead of the connection, e.g. to replay what was
+//read ahead of the data to relay.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
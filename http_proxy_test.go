@@ -0,0 +1,100 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHTTPProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" || r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("expected the proxy headers to be removed", r.Header)
+		}
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer origin.Close()
+	originAddr := strings.TrimPrefix(origin.URL, "http://")
+
+	p := NewProxy(ProxyOptions{Name: "http", Addr: "http://127.0.0.1:0"})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	defer p.Close()
+	proxyURL, _ := url.Parse("http://ci:secret@" + p.Addr())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	//absolute-URI request
+	resp, err := client.Get(origin.URL + "/path")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello /path" {
+		t.Error("unexpected body", string(body))
+	}
+	if p.Counters()["conns;"+originAddr+";Total"] != 1 || p.Counters()["bytes;"+originAddr+";In"] == 0 {
+		t.Error("expected the request to be counted", p.Counters())
+	}
+
+	//CONNECT, with data sent ahead of the reply
+	conn, err := net.Dial("tcp", p.Addr())
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT "+originAddr+" HTTP/1.1\r\nHost: "+originAddr+"\r\n\r\nGET /tunnel HTTP/1.1\r\nHost: "+originAddr+"\r\nConnection: close\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("expected the tunnel to be established", resp, err)
+	}
+	resp, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	if string(body) != "hello /tunnel" {
+		t.Error("unexpected body", string(body))
+	}
+
+	//denied
+	p.SetAccessMode(AccessMode{Mode: MODE_BLACKLIST})
+	p.SetBlacklistForHost("127.0.0.1", true)
+	resp, err = client.Get(origin.URL)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("expected the request to be forbidden, got", resp.Status)
+	}
+}
+
+func TestListenerProtocol(t *testing.T) {
+	s, err := CreateListener("http-suite", "http://127.0.0.1:0")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer DeleteSession("http-suite")
+	if !strings.HasPrefix(s.Addr, "http://127.0.0.1:") {
+		t.Error("expected the address to keep its scheme", s.Addr)
+	}
+	if _, err := CreateListener("ftp-suite", "ftp://localhost:0"); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+}
@@ -0,0 +1,115 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/tawawhite/go-socks5"
+)
+
+//Protocols of a listener, given by the scheme of its address, e.g. http://0.0.0.0:8080.
+//An address without a scheme serves SOCKS, and a listen->target address, e.g.
+//127.0.0.1:15432->db.internal:5432, forwards every connection to target.
+const (
+	PROTOCOL_SOCKS   = "socks"   //SOCKS5, and SOCKS4/4a
+	PROTOCOL_HTTP    = "http"    //HTTP CONNECT and absolute-URI forward proxy requests
+	PROTOCOL_FORWARD = "forward" //static port forward, for clients that can't use a proxy
+)
+
+//Listeners are sessions with a dedicated listen address, so every listener has
+//its own rules and counters. NewListenerForTcpCopyingProxy remains the shared
+//listener of DefaultSession.
+
+//CreateListener starts a listener on addr bound to a new session called name. It
+//serves SOCKS, an HTTP proxy for an http://host:port addr, or a forward for a
+//listen->target addr.
+func CreateListener(name, addr string) (*Session, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("listener %v has no address", name)
+	}
+	return CreateSession(name, "", nil, addr)
+}
+
+//DeleteListener closes the listener called name and deletes its session. Sessions
+//without a dedicated listener, e.g. routed by username, aren't deleted.
+func DeleteListener(name string) error {
+	return deleteSession(name, true)
+}
+
+//CreateListeners starts the listeners in a csv list of name=addr pairs. Listeners
+//that already exist, e.g. imported from a saved State, are kept as they are.
+func CreateListeners(csv string) error {
+	existing := Listeners()
+	for _, listener := range strings.Split(csv, ",") {
+		splt := strings.SplitN(listener, "=", 2)
+		if len(splt) != 2 {
+			return fmt.Errorf("invalid listener %q, expected name=addr", listener)
+		}
+		if _, exists := existing[splt[0]]; exists {
+			continue
+		}
+		if _, err := CreateListener(splt[0], splt[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Listeners maps the names of the sessions that have a dedicated listener to its address.
+func Listeners() map[string]string {
+	listeners := make(map[string]string)
+	sessionsSync.RLock()
+	for name, s := range Sessions {
+		if s.server != nil {
+			listeners[name] = s.Addr
+		}
+	}
+	sessionsSync.RUnlock()
+	return listeners
+}
+
+//listen listens on addr, with an optional protocol scheme or forward target, and
+//returns a server of session for it and the address it is bound to, with the
+//scheme of HTTP listeners and the target of forwards.
+func listen(addr string, session *Session) (*server, string, error) {
+	protocol, target := PROTOCOL_SOCKS, ""
+	var forward *socks5.AddrSpec
+	if splt := strings.SplitN(addr, "->", 2); len(splt) == 2 {
+		var err error
+		protocol, addr, target = PROTOCOL_FORWARD, strings.TrimSpace(splt[0]), strings.TrimSpace(splt[1])
+		if forward, err = hostAddr(target, ""); err != nil {
+			return nil, "", fmt.Errorf("invalid forward target %q: %v", target, err)
+		}
+	} else if splt := strings.SplitN(addr, "://", 2); len(splt) == 2 {
+		protocol, addr = splt[0], splt[1]
+		if protocol != PROTOCOL_SOCKS && protocol != PROTOCOL_HTTP {
+			return nil, "", fmt.Errorf("unknown listener protocol %q, expected %v or %v", protocol, PROTOCOL_SOCKS, PROTOCOL_HTTP)
+		}
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		var addrErr *net.AddrError
+		if errors.As(err, &addrErr) {
+			return nil, "", err
+		}
+		return nil, "", internalf("%v", err) //e.g. the address is in use
+	}
+	srv := newServer(l, session)
+	srv.protocol, srv.forward = protocol, forward
+	bound := l.Addr().String()
+	switch protocol {
+	case PROTOCOL_HTTP:
+		bound = protocol + "://" + bound
+	case PROTOCOL_FORWARD:
+		bound += "->" + target
+	}
+	return srv, bound, nil
+}
@@ -0,0 +1,156 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenersHaveIndependentProfiles(t *testing.T) {
+	if err := CreateListeners("suite-a=localhost:0,suite-b=localhost:0"); err != nil {
+		t.Fatal("got error", err)
+	}
+	defer DeleteSession("suite-a")
+	defer DeleteSession("suite-b")
+
+	listeners := Listeners()
+	if len(listeners) != 2 {
+		t.Fatal("expected 2 listeners", listeners)
+	}
+	a, _ := GetSession("suite-a")
+	b, _ := GetSession("suite-b")
+	a.SetLatencyForHost("localhost", PER_REMOTE_CONNECT, time.Duration(short_duration), -1)
+
+	duration, err := ClientRequestThroughProxy(listeners["suite-a"], nil)
+	if err != nil {
+		t.Error("got error", err)
+	}
+	if !inDurationRange(duration) {
+		t.Error("duration outside of expected range [1s,1.2s]", duration)
+	}
+
+	duration, err = ClientRequestThroughProxy(listeners["suite-b"], nil)
+	if err != nil {
+		t.Error("got error", err)
+	}
+	if duration > time.Duration(low_duration_range) {
+		t.Error("suite-b got the latency of suite-a", duration)
+	}
+
+	if a.Counters()[TOTAL_CONNS] != 1 || b.Counters()[TOTAL_CONNS] != 1 {
+		t.Error("expected one connection per listener", a.Counters(), b.Counters())
+	}
+	b.ResetCounters()
+	if len(b.Counters()) != 0 || a.Counters()[TOTAL_CONNS] != 1 {
+		t.Error("reset leaked across listeners", a.Counters(), b.Counters())
+	}
+
+	if _, err := CreateListener("suite-c", ""); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+
+	//existing listeners are kept
+	if err := CreateListeners("suite-a=localhost:0"); err != nil {
+		t.Error("got error", err)
+	}
+	if Listeners()["suite-a"] != listeners["suite-a"] {
+		t.Error("expected suite-a to keep its address", Listeners())
+	}
+}
+
+func TestDeleteListener(t *testing.T) {
+	if _, err := CreateSession("routed", "routed", nil, ""); err != nil {
+		t.Fatal("got error", err)
+	}
+	defer DeleteSession("routed")
+	if err := DeleteListener("routed"); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+	if _, err := GetSession("routed"); err != nil {
+		t.Error("expected a session without a listener to be kept", err)
+	}
+
+	if _, err := CreateListener("suite-d", "127.0.0.1:0"); err != nil {
+		t.Fatal("got error", err)
+	}
+	if err := DeleteListener("suite-d"); err != nil {
+		t.Error("got error", err)
+	}
+	if _, exists := Listeners()["suite-d"]; exists {
+		t.Error("expected suite-d to be deleted", Listeners())
+	}
+}
+
+func TestForward(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	target := upstream.Addr().String()
+
+	p := NewProxy(ProxyOptions{Name: "forward", Addr: "127.0.0.1:0 -> " + target})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	defer p.Close()
+	conn, err := net.Dial("tcp", p.Addr())
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	conn.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "ping" {
+		t.Error("unexpected echo", string(echo), err)
+	}
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	if p.Counters()["conns;"+target+";Total"] != 1 || p.Counters()["bytes;"+target+";In"] != 4 {
+		t.Error("expected the connection to be counted", p.Counters())
+	}
+
+	//the rules of the target apply
+	p.SetLatencyRuleForHost("127.0.0.1", PER_REMOTE_CONNECT, LatencyAndCountStruct{Count: 1, FailureRate: 1})
+	conn, err = net.Dial("tcp", p.Addr())
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(echo); err != io.EOF {
+		t.Error("expected the connection to be closed, got", err)
+	}
+
+	s, err := CreateListener("forward-suite", "127.0.0.1:0->"+target)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer DeleteSession("forward-suite")
+	if !strings.HasSuffix(s.Addr, "->"+target) {
+		t.Error("expected the address to keep its target", s.Addr)
+	}
+	if _, err := CreateListener("forward-invalid", "127.0.0.1:0->db.internal"); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+}
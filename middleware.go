@@ -0,0 +1,209 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/araddon/gou"
+	"github.com/tawawhite/go-socks5"
+)
+
+//Middleware lets embedders write their own faults in Go. Registered middleware is
+//invoked for every proxied connection, after the rules of its session, in the
+//order it was registered.
+//
+//OnConnect is called once the remote is connected. OnChunk is called for every
+//chunk read from either side, before it is written to the other; the returned
+//bytes are written instead, so a middleware can delay, drop (return an empty
+//slice), truncate or corrupt chunks. chunk is only valid during the call. OnClose
+//is called once the connection is closed, for every middleware whose OnConnect
+//succeeded. An error from OnConnect or OnChunk closes the connection.
+type Middleware interface {
+	OnConnect(conn *ConnInfo) error
+	OnChunk(conn *ConnInfo, dir Direction, chunk []byte) ([]byte, error)
+	OnClose(conn *ConnInfo)
+}
+
+//Direction of a chunk.
+type Direction int
+
+const (
+	OUTBOUND Direction = iota //from the client to the remote
+	INBOUND                   //from the remote to the client
+)
+
+func (d Direction) String() string {
+	if d == OUTBOUND {
+		return "Out"
+	}
+	return "In"
+}
+
+//ConnInfo describes a proxied connection to middleware. Values stores per-connection
+//state of the middleware; it is not shared across connections.
+type ConnInfo struct {
+	ID      string
+	Session string
+	Client  net.Addr
+	Remote  *socks5.AddrSpec
+	Values  sync.Map
+}
+
+//MiddlewareFuncs adapts functions to Middleware. Nil functions do nothing.
+type MiddlewareFuncs struct {
+	Connect func(conn *ConnInfo) error
+	Chunk   func(conn *ConnInfo, dir Direction, chunk []byte) ([]byte, error)
+	Close   func(conn *ConnInfo)
+}
+
+func (m MiddlewareFuncs) OnConnect(conn *ConnInfo) error {
+	if m.Connect == nil {
+		return nil
+	}
+	return m.Connect(conn)
+}
+
+func (m MiddlewareFuncs) OnChunk(conn *ConnInfo, dir Direction, chunk []byte) ([]byte, error) {
+	if m.Chunk == nil {
+		return chunk, nil
+	}
+	return m.Chunk(conn, dir, chunk)
+}
+
+func (m MiddlewareFuncs) OnClose(conn *ConnInfo) {
+	if m.Close != nil {
+		m.Close(conn)
+	}
+}
+
+type namedMiddleware struct {
+	name string
+	Middleware
+}
+
+//middlewareRegistry holds middleware in the order it was registered.
+type middlewareRegistry struct {
+	sync        sync.RWMutex
+	middlewares []namedMiddleware
+}
+
+//Middleware of the connections of the package level sessions. Each Proxy has its own.
+var middlewares middlewareRegistry
+
+//RegisterMiddleware adds m under name. Connections that are already established
+//keep the middleware they started with.
+func RegisterMiddleware(name string, m Middleware) error {
+	return middlewares.register(name, m)
+}
+
+//UnregisterMiddleware removes the middleware registered under name.
+func UnregisterMiddleware(name string) error {
+	return middlewares.unregister(name)
+}
+
+func (r *middlewareRegistry) register(name string, m Middleware) error {
+	r.sync.Lock()
+	defer r.sync.Unlock()
+	for _, other := range r.middlewares {
+		if other.name == name {
+			return conflictf("middleware %v already exists", name)
+		}
+	}
+	r.middlewares = append(r.middlewares, namedMiddleware{name, m})
+	gou.Infof("Registered middleware %v", name)
+	return nil
+}
+
+func (r *middlewareRegistry) unregister(name string) error {
+	r.sync.Lock()
+	defer r.sync.Unlock()
+	for i, other := range r.middlewares {
+		if other.name == name {
+			r.middlewares = append(r.middlewares[:i:i], r.middlewares[i+1:]...)
+			gou.Infof("Unregistered middleware %v", name)
+			return nil
+		}
+	}
+	return notFoundf("middleware %v does not exist", name)
+}
+
+func (r *middlewareRegistry) registered() []namedMiddleware {
+	r.sync.RLock()
+	defer r.sync.RUnlock()
+	return r.middlewares
+}
+
+//A middlewareChain runs the middleware of one connection.
+type middlewareChain struct {
+	conn        *ConnInfo
+	middlewares []namedMiddleware
+}
+
+//connectMiddleware calls OnConnect on the middleware of r. On error, the
+//middleware that was already connected is closed.
+func connectMiddleware(r *middlewareRegistry, conn *ConnInfo) (*middlewareChain, error) {
+	chain := &middlewareChain{conn: conn}
+	for _, m := range r.registered() {
+		if err := m.OnConnect(conn); err != nil {
+			gou.Infof("Closing connection per middleware %v. err=%v; Address=%v; rid=%v;", m.name, err, *conn.Remote, conn.ID)
+			chain.close()
+			return nil, err
+		}
+		chain.middlewares = append(chain.middlewares, m)
+	}
+	return chain, nil
+}
+
+func (c *middlewareChain) chunk(dir Direction, chunk []byte) ([]byte, error) {
+	for _, m := range c.middlewares {
+		var err error
+		if chunk, err = m.OnChunk(c.conn, dir, chunk); err != nil {
+			gou.Infof("Closing connection per middleware %v. err=%v; Address=%v; rid=%v;", m.name, err, *c.conn.Remote, c.conn.ID)
+			return nil, err
+		}
+	}
+	return chunk, nil
+}
+
+func (c *middlewareChain) close() {
+	for _, m := range c.middlewares {
+		m.OnClose(c.conn)
+	}
+}
+
+//copy copies src to dst through the middleware until either fails, and returns
+//the number of bytes written.
+func (c *middlewareChain) copy(dst net.Conn, src net.Conn, dir Direction) (int64, error) {
+	if len(c.middlewares) == 0 {
+		return io.Copy(dst, src) //Direct copy
+	}
+	written := int64(0)
+	data := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(data)
+		if n > 0 {
+			chunk, err := c.chunk(dir, data[:n])
+			if err != nil {
+				return written, err
+			}
+			m, err := dst.Write(chunk)
+			written += int64(m)
+			if err != nil {
+				return written, err
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,86 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	var connects, outbound, inbound, closes int64
+	err := RegisterMiddleware("counting", MiddlewareFuncs{
+		Connect: func(conn *ConnInfo) error {
+			atomic.AddInt64(&connects, 1)
+			return nil
+		},
+		Chunk: func(conn *ConnInfo, dir Direction, chunk []byte) ([]byte, error) {
+			if dir == OUTBOUND {
+				atomic.AddInt64(&outbound, 1)
+			} else {
+				atomic.AddInt64(&inbound, 1)
+			}
+			return chunk, nil
+		},
+		Close: func(conn *ConnInfo) {
+			atomic.AddInt64(&closes, 1)
+		},
+	})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if err := RegisterMiddleware("counting", MiddlewareFuncs{}); !errors.Is(err, ErrConflict) {
+		t.Error("expected conflict, got", err)
+	}
+
+	if _, err := ClientRequestThroughProxy("localhost:9000", nil); err != nil {
+		t.Error("got error", err)
+	}
+	time.Sleep(300e6) //connections close shortly after the response
+	if atomic.LoadInt64(&connects) != 1 || atomic.LoadInt64(&closes) != 1 {
+		t.Error("expected one connect and one close", connects, closes)
+	}
+	if atomic.LoadInt64(&outbound) == 0 || atomic.LoadInt64(&inbound) == 0 {
+		t.Error("expected chunks in both directions", outbound, inbound)
+	}
+
+	if err := UnregisterMiddleware("counting"); err != nil {
+		t.Error("got error", err)
+	}
+	if err := UnregisterMiddleware("counting"); !errors.Is(err, ErrNotFound) {
+		t.Error("expected not found, got", err)
+	}
+}
+
+func TestMiddlewareCloses(t *testing.T) {
+	RegisterMiddleware("reject", MiddlewareFuncs{
+		Connect: func(conn *ConnInfo) error {
+			return errors.New("rejected")
+		},
+	})
+	_, err := SimpleClientRequest()
+	UnregisterMiddleware("reject")
+	if err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+
+	RegisterMiddleware("drop", MiddlewareFuncs{
+		Chunk: func(conn *ConnInfo, dir Direction, chunk []byte) ([]byte, error) {
+			if dir == INBOUND {
+				return nil, errors.New("dropped")
+			}
+			return chunk, nil
+		},
+	})
+	_, err = SimpleClientRequest()
+	UnregisterMiddleware("drop")
+	if err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+}
@@ -0,0 +1,126 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/araddon/gou"
+)
+
+//ProxyOptions configure a Proxy.
+type ProxyOptions struct {
+	Name       string //of the proxy's session, for logs. Defaults to "proxy".
+	Addr       string //to listen on, e.g. localhost:0 for any free port, or http://localhost:0 for an HTTP proxy
+	Blacklist  bool   //enables blacklist rules
+	Whitelist  bool   //enables whitelist rules
+	Precedence string //of the lists when both are enabled, PRECEDENCE_DENY if empty
+
+	//DeniedReply is the SOCKS5 reply code of the requests the access mode denies,
+	//REPLY_NOT_ALLOWED if 0.
+	DeniedReply byte
+}
+
+//A Proxy is a destructive proxy that Go programs, e.g. tests, can embed, start on a
+//free port and close. Each Proxy has its own listener, rules, counters, schedules
+//and middleware: its Session is not one of the package level sessions and doesn't
+//count towards the process wide Counters.
+//
+//	p := dsp.NewProxy(dsp.ProxyOptions{Addr: "localhost:0"})
+//	if err := p.Start(ctx); err != nil {
+//		t.Fatal(err)
+//	}
+//	defer p.Close()
+//	p.SetLatencyForHost("db.internal", dsp.PER_REMOTE_WRITE, 2*time.Second, -1)
+type Proxy struct {
+	*Session
+	options     ProxyOptions
+	middlewares middlewareRegistry
+	server      *server
+	sync        sync.Mutex
+	closed      bool
+	done        chan struct{}
+}
+
+func NewProxy(options ProxyOptions) *Proxy {
+	if options.Name == "" {
+		options.Name = "proxy"
+	}
+	p := &Proxy{options: options, done: make(chan struct{})}
+	p.Session = &Session{Name: options.Name, Created: time.Now(), rules: NewRuleEngine(options.Name), counters: make(map[string]float64), proxy: p}
+	return p
+}
+
+//Start listens on the proxy's address and serves connections in the background
+//until the proxy is closed, or ctx is done.
+func (p *Proxy) Start(ctx context.Context) error {
+	p.sync.Lock()
+	defer p.sync.Unlock()
+	if p.server != nil || p.closed {
+		return fmt.Errorf("proxy %v was already started", p.Name)
+	}
+	srv, addr, err := listen(p.options.Addr, p.Session)
+	if err != nil {
+		return err
+	}
+	p.server = srv
+	go p.server.serve()
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Close()
+		case <-p.done:
+		}
+	}()
+	gou.Infof("Started proxy %v on %v", p.Name, addr)
+	return nil
+}
+
+//Addr returns the host:port the proxy listens on, empty until it is started.
+func (p *Proxy) Addr() string {
+	p.sync.Lock()
+	defer p.sync.Unlock()
+	if p.server == nil {
+		return ""
+	}
+	return p.server.listener.Addr().String()
+}
+
+//Close stops accepting connections, closes the active ones and waits for them to
+//be done, and stops the proxy's schedules. Closing a closed proxy does nothing.
+func (p *Proxy) Close() error {
+	p.sync.Lock()
+	if p.closed {
+		p.sync.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	srv := p.server
+	p.sync.Unlock()
+
+	p.stopSchedules()
+	if srv == nil {
+		return nil
+	}
+	err := srv.close()
+	gou.Infof("Closed proxy %v", p.Name)
+	return err
+}
+
+//RegisterMiddleware adds m under name to the proxy's connections.
+func (p *Proxy) RegisterMiddleware(name string, m Middleware) error {
+	return p.middlewares.register(name, m)
+}
+
+//UnregisterMiddleware removes the middleware registered under name from the proxy.
+func (p *Proxy) UnregisterMiddleware(name string) error {
+	return p.middlewares.unregister(name)
+}
@@ -0,0 +1,109 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestProxy(t *testing.T) {
+	a, b := NewProxy(ProxyOptions{Name: "a", Addr: "localhost:0"}), NewProxy(ProxyOptions{Name: "b", Addr: "localhost:0", Blacklist: true})
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	defer a.Close()
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	defer b.Close()
+	if a.Addr() == "" || a.Addr() == b.Addr() {
+		t.Fatal("expected distinct addresses", a.Addr(), b.Addr())
+	}
+	if err := a.Start(context.Background()); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+
+	a.SetLatencyForHost("localhost", PER_REMOTE_CONNECT, time.Duration(short_duration), -1)
+	duration, err := ClientRequestThroughProxy(a.Addr(), nil)
+	if err != nil {
+		t.Error("got error", err)
+	}
+	if !inDurationRange(duration) {
+		t.Error("duration outside of expected range [1s,1.2s]", duration)
+	}
+	if duration, _ := ClientRequestThroughProxy(b.Addr(), nil); duration > time.Duration(low_duration_range) {
+		t.Error("latency leaked across proxies", duration)
+	}
+	if a.Counters()[TOTAL_CONNS] != 1 || b.Counters()[TOTAL_CONNS] != 1 {
+		t.Error("expected one connection per proxy", a.Counters(), b.Counters())
+	}
+
+	if _, err := a.SetBlacklistForHost("localhost", true); err != nil {
+		t.Error("got error", err)
+	}
+	if _, err := ClientRequestThroughProxy(a.Addr(), nil); err != nil {
+		t.Error("expected the blacklist to be disabled on a, got error", err)
+	}
+	if _, err := b.SetBlacklistForHost("localhost", true); err != nil {
+		t.Error("got error", err)
+	}
+	if _, err := ClientRequestThroughProxy(b.Addr(), nil); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+}
+
+func TestProxyClose(t *testing.T) {
+	p := NewProxy(ProxyOptions{Addr: "localhost:0"})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	addr := p.Addr()
+
+	//a connection that stays open until the proxy closes it
+	p.SetLatencyForHost("localhost", PER_REMOTE_CONNECT, 10*time.Second, -1)
+	done := make(chan error)
+	go func() {
+		_, err := ClientRequestThroughProxy(addr, nil)
+		done <- err
+	}()
+	time.Sleep(200e6)
+
+	st := time.Now()
+	if err := p.Close(); err != nil {
+		t.Error("got error", err)
+	}
+	if time.Since(st) > time.Second {
+		t.Error("close took too long", time.Since(st))
+	}
+	if err := <-done; err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+	if err := p.Close(); err != nil {
+		t.Error("closing again got error", err)
+	}
+	if _, err := ClientRequestThroughProxy(addr, nil); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+}
+
+func TestProxyContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewProxy(ProxyOptions{Addr: "localhost:0"})
+	if err := p.Start(ctx); err != nil {
+		t.Fatal("got error", err)
+	}
+	if _, err := ClientRequestThroughProxy(p.Addr(), nil); err != nil {
+		t.Error("got error", err)
+	}
+	cancel()
+	time.Sleep(200e6)
+	if _, err := ClientRequestThroughProxy(p.Addr(), nil); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+}
@@ -0,0 +1,455 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/araddon/gou"
+	"github.com/dchest/uniuri"
+	"github.com/tawawhite/go-socks5"
+)
+
+const (
+	WHITELIST = "whitelist" //Rule type that allows connections when Whitelist is set.
+	BLACKLIST = "blacklist" //Rule and schedule type that denies connections when Blacklist is set.
+	ANY_HOST  = "*"         //Rule host that matches every connection.
+)
+
+//Errors that wrap ErrNotFound, ErrConflict or ErrInternal, a failure of the proxy
+//rather than of the request, can be told apart with errors.Is.
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("conflict")
+	ErrInternal = errors.New("internal error")
+)
+
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e kindError) Error() string { return e.msg }
+func (e kindError) Unwrap() error { return e.kind }
+
+func notFoundf(format string, v ...interface{}) error {
+	return kindError{ErrNotFound, fmt.Sprintf(format, v...)}
+}
+
+func conflictf(format string, v ...interface{}) error {
+	return kindError{ErrConflict, fmt.Sprintf(format, v...)}
+}
+
+func internalf(format string, v ...interface{}) error {
+	return kindError{ErrInternal, fmt.Sprintf(format, v...)}
+}
+
+//A Rule is a matcher, a fault action and its limits.
+//
+//Type is the action, one of PER_REMOTE_WRITE, PER_REMOTE_READ, PER_REMOTE_CONNECT,
+//PER_REMOTE_UDP, BLACKLIST or WHITELIST. Host is an ip, a host name, a cidr or
+//ANY_HOST, and Match is what it resolved to when the rule was set. Count (< 0 for no
+//limit), Start and Expires limit when the rule applies, whatever its type; the
+//latency fields are only used by the latency and udp types, and UDP by the udp
+//type. Rules with a higher Priority are evaluated first.
+type Rule struct {
+	ID       string
+	Type     string
+	Host     string `json:",omitempty"`
+	Match    string
+	Priority int `json:",omitempty"`
+	LatencyAndCountStruct
+	UDP *UDPFaults `json:",omitempty"`
+
+	ipnet *net.IPNet //nil for ANY_HOST
+	seq   int
+}
+
+type ruleKey struct {
+	Type  string
+	Match string
+}
+
+func (r *Rule) key() ruleKey {
+	return ruleKey{r.Type, r.Match}
+}
+
+//compile resolves Host into Match.
+func (r *Rule) compile() error {
+	if r.Host == "" {
+		r.Host = r.Match
+	}
+	switch {
+	case r.Host == "":
+		return fmt.Errorf("rule needs a host")
+	case r.Host == ANY_HOST:
+		r.Match, r.ipnet = ANY_HOST, nil
+	case strings.Contains(r.Host, "/"):
+		_, ipnet, err := net.ParseCIDR(r.Host)
+		if err != nil {
+			return err
+		}
+		r.Match, r.ipnet = ipnet.String(), ipnet
+	default:
+		ip, err := socks5.ResolveToIpCaching(r.Host)
+		if err != nil {
+			return err
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.Match, r.ipnet = ip.String(), &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	return nil
+}
+
+//validate checks the rule's action and limits and compiles its matcher.
+func (r *Rule) validate() error {
+	switch r.Type {
+	case PER_REMOTE_WRITE, PER_REMOTE_READ, PER_REMOTE_CONNECT:
+		if r.Latency <= 0 && r.FailureRate <= 0 {
+			return fmt.Errorf("rule needs a latency or a failure rate")
+		}
+		if r.FailureRate < 0 || r.FailureRate > 1 {
+			return fmt.Errorf("failure rate %v is not in [0,1]", r.FailureRate)
+		}
+	case PER_REMOTE_UDP:
+		if r.FailureRate < 0 || r.FailureRate > 1 {
+			return fmt.Errorf("drop rate %v is not in [0,1]", r.FailureRate)
+		}
+		if r.UDP != nil {
+			if err := r.UDP.validate(); err != nil {
+				return err
+			}
+		}
+		if r.Latency <= 0 && r.FailureRate <= 0 && (r.UDP == nil || *r.UDP == (UDPFaults{})) {
+			return fmt.Errorf("udp rule needs a latency, a drop rate, a duplicate rate, a reorder rate or a truncate size")
+		}
+	case BLACKLIST, WHITELIST:
+	default:
+		return fmt.Errorf("unknown rule type %v", r.Type)
+	}
+	if r.UDP != nil && r.Type != PER_REMOTE_UDP {
+		return fmt.Errorf("only udp rules have udp faults")
+	}
+	if r.Count == 0 {
+		return fmt.Errorf("rule count must be > 0, or < 0 for no limit")
+	}
+	if r.Ramp != nil {
+		if r.Ramp.Up < 0 || r.Ramp.Hold < 0 || r.Ramp.Down < 0 {
+			return fmt.Errorf("invalid ramp %+v", *r.Ramp)
+		}
+		if r.Start.IsZero() {
+			r.Start = time.Now()
+		}
+		if r.Ramp.Down > 0 && r.Expires.IsZero() { //nothing left to do once ramped down
+			r.Expires = r.Start.Add(r.Ramp.Up + r.Ramp.Hold + r.Ramp.Down)
+		}
+	}
+	if !r.Expires.IsZero() && !r.Expires.After(r.Start) {
+		return fmt.Errorf("rule expires at %v, before it starts at %v", r.Expires, r.Start)
+	}
+	return r.compile()
+}
+
+func (r *Rule) matches(ips []net.IP) bool {
+	if r.ipnet == nil {
+		return true
+	}
+	for _, ip := range ips {
+		if r.ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//A RuleEngine holds an ordered list of rules. Rules are evaluated by descending
+//Priority, then in the order they were first set; the first active rule of a type
+//that matches a connection applies. There is at most one rule per type and match,
+//and its id stays the same for as long as the engine exists, so a rule that is set
+//again after it was removed gets its old id back.
+type RuleEngine struct {
+	name  string //for logs
+	sync  sync.RWMutex
+	rules []*Rule
+	ids   map[ruleKey]string
+	seq   int
+}
+
+func NewRuleEngine(name string) *RuleEngine {
+	return &RuleEngine{name: name, ids: make(map[ruleKey]string)}
+}
+
+//Must be called with e.sync held.
+func (e *RuleEngine) id(key ruleKey) string {
+	if id, exists := e.ids[key]; exists {
+		return id
+	}
+	id := uniuri.NewLen(12)
+	e.ids[key] = id
+	return id
+}
+
+//Must be called with e.sync held.
+func (e *RuleEngine) index(id string) int {
+	for i, rule := range e.rules {
+		if rule.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+//Must be called with e.sync held.
+func (e *RuleEngine) indexOf(key ruleKey) int {
+	for i, rule := range e.rules {
+		if rule.key() == key {
+			return i
+		}
+	}
+	return -1
+}
+
+//Must be called with e.sync held.
+func (e *RuleEngine) sort() {
+	sort.SliceStable(e.rules, func(i, j int) bool {
+		if e.rules[i].Priority != e.rules[j].Priority {
+			return e.rules[i].Priority > e.rules[j].Priority
+		}
+		return e.rules[i].seq < e.rules[j].seq
+	})
+}
+
+//Must be called with e.sync held.
+func (e *RuleEngine) remove(i int) {
+	e.rules = append(e.rules[:i], e.rules[i+1:]...)
+}
+
+//Set adds rule, or replaces the rule of the same type for the same match in its
+//place, and returns it with its id. Rules with an expiry remove themselves once
+//it passes.
+func (e *RuleEngine) Set(rule Rule) (Rule, error) {
+	if err := rule.validate(); err != nil {
+		return Rule{}, err
+	}
+
+	e.sync.Lock()
+	rule.ID = e.id(rule.key())
+	if i := e.indexOf(rule.key()); i >= 0 {
+		rule.seq = e.rules[i].seq
+		e.rules[i] = &rule
+	} else {
+		e.seq++
+		rule.seq = e.seq
+		e.rules = append(e.rules, &rule)
+	}
+	e.sort()
+	e.sync.Unlock()
+
+	e.expireAt(rule)
+	return rule, nil
+}
+
+//Update replaces the rule with the given id. The type of a rule can't change. If
+//the match changes, the id moves to the new match.
+func (e *RuleEngine) Update(id string, rule Rule) (Rule, error) {
+	old, err := e.Get(id)
+	if err != nil {
+		return Rule{}, err
+	}
+	if rule.Type == "" {
+		rule.Type = old.Type
+	}
+	if rule.Type != old.Type {
+		return Rule{}, fmt.Errorf("rule %v is a %v rule, its type can't change", id, old.Type)
+	}
+	if err := rule.validate(); err != nil {
+		return Rule{}, err
+	}
+
+	e.sync.Lock()
+	i := e.index(id)
+	if i < 0 {
+		e.sync.Unlock()
+		return Rule{}, notFoundf("rule %v does not exist in %v", id, e.name)
+	}
+	if other := e.indexOf(rule.key()); other >= 0 && other != i {
+		e.sync.Unlock()
+		return Rule{}, conflictf("rule %v already exists for %v", e.rules[other].ID, rule.Match)
+	}
+	delete(e.ids, e.rules[i].key())
+	e.ids[rule.key()] = id
+	rule.ID, rule.seq = id, e.rules[i].seq
+	e.rules[i] = &rule
+	e.sort()
+	e.sync.Unlock()
+
+	e.expireAt(rule)
+	return rule, nil
+}
+
+func (e *RuleEngine) expireAt(rule Rule) {
+	if rule.Expires.IsZero() {
+		return
+	}
+	time.AfterFunc(rule.Expires.Sub(time.Now()), func() {
+		e.sync.Lock()
+		i := e.index(rule.ID)
+		expired := i >= 0 && e.rules[i].Expires.Equal(rule.Expires)
+		if expired {
+			e.remove(i)
+		}
+		e.sync.Unlock()
+
+		if expired {
+			gou.Infof("Expired %v rule for %v. id=%v; expires=%v; session=%v;", rule.Type, rule.Match, rule.ID, rule.Expires, e.name)
+		}
+	})
+}
+
+//Get returns the rule with the given id.
+func (e *RuleEngine) Get(id string) (Rule, error) {
+	e.sync.RLock()
+	defer e.sync.RUnlock()
+	if i := e.index(id); i >= 0 {
+		return *e.rules[i], nil
+	}
+	return Rule{}, notFoundf("rule %v does not exist in %v", id, e.name)
+}
+
+//Lookup returns the _type rule for the given match, if it is set.
+func (e *RuleEngine) Lookup(_type, match string) (Rule, bool) {
+	e.sync.RLock()
+	defer e.sync.RUnlock()
+	if i := e.indexOf(ruleKey{_type, match}); i >= 0 {
+		return *e.rules[i], true
+	}
+	return Rule{}, false
+}
+
+//List returns the rules in evaluation order.
+func (e *RuleEngine) List() []Rule {
+	e.sync.RLock()
+	defer e.sync.RUnlock()
+	rules := make([]Rule, 0, len(e.rules))
+	for _, rule := range e.rules {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+//Remove removes the rule with the given id.
+func (e *RuleEngine) Remove(id string) error {
+	e.sync.Lock()
+	defer e.sync.Unlock()
+	if i := e.index(id); i >= 0 {
+		e.remove(i)
+		return nil
+	}
+	return notFoundf("rule %v does not exist in %v", id, e.name)
+}
+
+//RemoveMatch removes the _type rule for the given match, if it is set.
+func (e *RuleEngine) RemoveMatch(_type, match string) {
+	e.sync.Lock()
+	defer e.sync.Unlock()
+	if i := e.indexOf(ruleKey{_type, match}); i >= 0 {
+		e.remove(i)
+	}
+}
+
+//Apply returns the first active _type rule that matches any of ips, and counts it
+//down. A rule that was counted down to zero stays listed until the next time it
+//matches, when it is removed instead.
+func (e *RuleEngine) Apply(_type string, ips ...net.IP) (Rule, bool) {
+	now := time.Now()
+	e.sync.Lock()
+	defer e.sync.Unlock()
+	for i := 0; i < len(e.rules); i++ {
+		rule := e.rules[i]
+		if rule.Type != _type || !rule.active(now) || !rule.matches(ips) {
+			continue
+		}
+		if rule.Count == 0 { //was explicitly set and reached zero
+			e.remove(i)
+			i--
+			continue
+		}
+		applied := *rule
+		if rule.Count >= 1 { //was explicitly set
+			rule.Count--
+		} // rule.Count < 0 => no limit
+		return applied, true
+	}
+	return Rule{}, false
+}
+
+//addrIPs returns the ips rules are matched against for remote_addr: its ip, and
+//the ip its FQDN resolves to.
+func addrIPs(remote_addr *socks5.AddrSpec) []net.IP {
+	ips := []net.IP{}
+	if remote_addr.IP != nil {
+		ips = append(ips, remote_addr.IP)
+	}
+	if remote_addr.FQDN != "" {
+		if ip, err := socks5.ResolveToIpCaching(remote_addr.FQDN); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+//Session rules are kept in the session's RuleEngine.
+
+//ListRules returns the session's rules in evaluation order.
+func (s *Session) ListRules() []Rule {
+	return s.rules.List()
+}
+
+//GetRule returns the rule with the given id.
+func (s *Session) GetRule(id string) (Rule, error) {
+	return s.rules.Get(id)
+}
+
+//AddRule sets rule, replacing a rule of the same type for the same match, and
+//returns it with its id.
+func (s *Session) AddRule(rule Rule) (Rule, error) {
+	rule, err := s.rules.Set(rule)
+	if err != nil {
+		return Rule{}, err
+	}
+	gou.Infof("Set %v rule for %v (%v). id=%v; priority=%v; count=%v; session=%v;", rule.Type, rule.Host, rule.Match, rule.ID, rule.Priority, rule.Count, s.Name)
+	return rule, nil
+}
+
+//UpdateRule replaces the rule with the given id. The type of a rule can't change.
+//If the host changes, the id moves to the new host.
+func (s *Session) UpdateRule(id string, rule Rule) (Rule, error) {
+	rule, err := s.rules.Update(id, rule)
+	if err != nil {
+		return Rule{}, err
+	}
+	gou.Infof("Updated %v rule for %v (%v). id=%v; priority=%v; count=%v; session=%v;", rule.Type, rule.Host, rule.Match, rule.ID, rule.Priority, rule.Count, s.Name)
+	return rule, nil
+}
+
+//DeleteRule removes the rule with the given id.
+func (s *Session) DeleteRule(id string) error {
+	if err := s.rules.Remove(id); err != nil {
+		return err
+	}
+	gou.Infof("Deleted rule %v. session=%v;", id, s.Name)
+	return nil
+}
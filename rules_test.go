@@ -0,0 +1,119 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRuleIDs(t *testing.T) {
+	s, err := CreateSession("rules", "", nil, "")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer DeleteSession("rules")
+
+	latency := Rule{Type: PER_REMOTE_WRITE, Host: "127.0.0.1"}
+	latency.Latency, latency.Count = 100*time.Millisecond, -1
+	added, err := s.AddRule(latency)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if added.ID == "" || added.Match != "127.0.0.1" {
+		t.Error("unexpected rule", added)
+	}
+	Blacklist = true
+	defer func() { Blacklist = false }()
+	if _, err := s.AddRule(Rule{Type: BLACKLIST, Host: "127.0.0.1", LatencyAndCountStruct: LatencyAndCountStruct{Count: -1}}); err != nil {
+		t.Fatal("got error", err)
+	}
+	if rules := s.ListRules(); len(rules) != 2 || rules[0].ID != added.ID || rules[1].Type != BLACKLIST {
+		t.Error("unexpected rules", rules)
+	}
+
+	latency.Latency = 200 * time.Millisecond
+	updated, err := s.UpdateRule(added.ID, latency)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if updated.ID != added.ID || updated.Latency != 200*time.Millisecond {
+		t.Error("unexpected rule", updated)
+	}
+	if _, err := s.UpdateRule(added.ID, Rule{Type: BLACKLIST, Host: "127.0.0.1"}); err == nil {
+		t.Error("expected an error changing the type of a rule")
+	}
+
+	if err := s.DeleteRule(added.ID); err != nil {
+		t.Fatal("got error", err)
+	}
+	if _, err := s.GetRule(added.ID); !errors.Is(err, ErrNotFound) {
+		t.Error("expected not found, got", err)
+	}
+	if err := s.DeleteRule(added.ID); !errors.Is(err, ErrNotFound) {
+		t.Error("expected not found, got", err)
+	}
+
+	again, err := s.AddRule(latency)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if again.ID != added.ID {
+		t.Error("expected the same id for the same rule", again.ID, added.ID)
+	}
+	if _, err := CreateSession("rules", "", nil, ""); !errors.Is(err, ErrConflict) {
+		t.Error("expected conflict, got", err)
+	}
+}
+
+func TestRuleEnginePriority(t *testing.T) {
+	e := NewRuleEngine("test")
+	rule := func(host string, priority int, latency time.Duration, count int) Rule {
+		r := Rule{Type: PER_REMOTE_WRITE, Host: host, Priority: priority}
+		r.Latency, r.Count = latency, count
+		return r
+	}
+	ip := net.ParseIP("10.1.2.3")
+
+	if _, err := e.Set(rule(ANY_HOST, 0, 1, -1)); err != nil {
+		t.Fatal("got error", err)
+	}
+	if _, err := e.Set(rule("10.0.0.0/8", 0, 2, -1)); err != nil {
+		t.Fatal("got error", err)
+	}
+	if applied, _ := e.Apply(PER_REMOTE_WRITE, ip); applied.Match != ANY_HOST {
+		t.Error("expected the first rule set to apply, got", applied)
+	}
+
+	if _, err := e.Set(rule("10.1.2.3", 10, 3, 1)); err != nil {
+		t.Fatal("got error", err)
+	}
+	if applied, _ := e.Apply(PER_REMOTE_WRITE, ip); applied.Latency != 3 {
+		t.Error("expected the highest priority rule to apply, got", applied)
+	}
+	if counted, _ := e.Lookup(PER_REMOTE_WRITE, "10.1.2.3"); counted.Count != 0 {
+		t.Error("expected the rule to be counted down", counted)
+	}
+	if applied, _ := e.Apply(PER_REMOTE_WRITE, ip); applied.Match != ANY_HOST {
+		t.Error("expected the counted down rule to be skipped, got", applied)
+	}
+	if _, exists := e.Lookup(PER_REMOTE_WRITE, "10.1.2.3"); exists {
+		t.Error("expected the counted down rule to be removed")
+	}
+
+	if _, exists := e.Apply(PER_REMOTE_READ, ip); exists {
+		t.Error("expected no rule of another type to apply")
+	}
+	if _, err := e.Set(rule("10.0.0.0/8", 0, 2, 0)); err == nil {
+		t.Error("expected an error for a count of zero")
+	}
+	if rules := e.List(); len(rules) != 2 || rules[0].Match != ANY_HOST || rules[1].Match != "10.0.0.0/8" {
+		t.Error("unexpected rules", rules)
+	}
+}
@@ -0,0 +1,389 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/araddon/gou"
+)
+
+//Scenario step actions
+const (
+	STEP_SET_LATENCY      = "set_latency"
+	STEP_CLEAR_LATENCY    = "clear_latency"
+	STEP_BLACKLIST_ADD    = "blacklist_add"
+	STEP_BLACKLIST_REMOVE = "blacklist_remove"
+	STEP_WHITELIST_ADD    = "whitelist_add"
+	STEP_WHITELIST_REMOVE = "whitelist_remove"
+	STEP_WAIT             = "wait"
+	STEP_ASSERT           = "assert"
+)
+
+//Scenario states
+const (
+	SCENARIO_READY     = "ready"
+	SCENARIO_RUNNING   = "running"
+	SCENARIO_PAUSED    = "paused"
+	SCENARIO_ABORTED   = "aborted"
+	SCENARIO_FAILED    = "failed"
+	SCENARIO_COMPLETED = "completed"
+)
+
+//How often running scenarios check for pause and abort, and poll counters for asserts.
+var scenarioTick = 100 * time.Millisecond
+
+//A ScenarioStep is one step of a Scenario. Durations are duration strings (e.g., 100ms, 30s).
+//
+//	set_latency: Host, Type, Latency, optional Count
+//	clear_latency: Host, Type
+//	blacklist_add, blacklist_remove, whitelist_add, whitelist_remove: Host
+//	wait: Duration
+//	assert: Counter Op Value, where Op is one of == != < <= > >=. Counters that
+//	weren't counted yet are 0. With a Timeout, polls until the assert holds.
+type ScenarioStep struct {
+	Action   string
+	Host     string  `json:",omitempty"`
+	Type     string  `json:",omitempty"`
+	Latency  string  `json:",omitempty"`
+	Count    int     `json:",omitempty"`
+	Duration string  `json:",omitempty"`
+	Counter  string  `json:",omitempty"`
+	Op       string  `json:",omitempty"`
+	Value    float64 `json:",omitempty"`
+	Timeout  string  `json:",omitempty"`
+}
+
+//A Scenario is a sequence of steps run against the rules and counters of a session.
+type Scenario struct {
+	Name     string
+	Session  string `json:",omitempty"`
+	Steps    []ScenarioStep
+	State    string
+	Step     int    //index of the step being run
+	Error    string `json:",omitempty"`
+	Started  time.Time
+	Finished time.Time
+
+	sync sync.RWMutex
+	run  int //incremented on each start, so an aborted run doesn't resume with the next one
+}
+
+var (
+	Scenarios     = make(map[string]*Scenario)
+	scenariosSync sync.RWMutex
+)
+
+//UploadScenario parses and validates a json scenario and registers it, replacing
+//a scenario of the same name that isn't running.
+func UploadScenario(data []byte) (*Scenario, error) {
+	sc := &Scenario{}
+	if err := json.Unmarshal(data, sc); err != nil {
+		return nil, err
+	}
+	if sc.Name == "" {
+		return nil, fmt.Errorf("scenario has no name")
+	}
+	for i, step := range sc.Steps {
+		if err := step.validate(); err != nil {
+			return nil, fmt.Errorf("step %v: %v", i, err)
+		}
+	}
+	sc.State, sc.Step, sc.Error, sc.Started, sc.Finished = SCENARIO_READY, 0, "", time.Time{}, time.Time{}
+
+	scenariosSync.Lock()
+	defer scenariosSync.Unlock()
+	if old, exists := Scenarios[sc.Name]; exists {
+		if state := old.status().State; state == SCENARIO_RUNNING || state == SCENARIO_PAUSED {
+			return nil, conflictf("scenario %v is %v", sc.Name, state)
+		}
+	}
+	Scenarios[sc.Name] = sc
+	gou.Infof("Uploaded scenario %v. steps=%v; session=%v;", sc.Name, len(sc.Steps), sc.Session)
+	return sc, nil
+}
+
+func getScenario(name string) (*Scenario, error) {
+	scenariosSync.RLock()
+	defer scenariosSync.RUnlock()
+	if sc, exists := Scenarios[name]; exists {
+		return sc, nil
+	}
+	return nil, notFoundf("scenario %v does not exist", name)
+}
+
+//GetScenario returns the progress of a scenario.
+func GetScenario(name string) (ScenarioStatus, error) {
+	sc, err := getScenario(name)
+	if err != nil {
+		return ScenarioStatus{}, err
+	}
+	return sc.status(), nil
+}
+
+//ListScenarios returns the progress of all scenarios, sorted by name.
+func ListScenarios() []ScenarioStatus {
+	statuses := []ScenarioStatus{}
+	scenariosSync.RLock()
+	for _, sc := range Scenarios {
+		statuses = append(statuses, sc.status())
+	}
+	scenariosSync.RUnlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+//StartScenario runs a scenario from its first step, or resumes a paused one.
+//Finished scenarios can be started again.
+func StartScenario(name string) error {
+	sc, err := getScenario(name)
+	if err != nil {
+		return err
+	}
+	if _, err := GetSession(sc.Session); err != nil {
+		return err
+	}
+
+	sc.sync.Lock()
+	defer sc.sync.Unlock()
+	switch sc.State {
+	case SCENARIO_RUNNING:
+		return fmt.Errorf("scenario %v is already running", name)
+	case SCENARIO_PAUSED:
+		sc.State = SCENARIO_RUNNING
+		gou.Infof("Resumed scenario %v at step %v", name, sc.Step)
+		return nil
+	}
+	sc.State, sc.Step, sc.Error, sc.Started, sc.Finished = SCENARIO_RUNNING, 0, "", time.Now(), time.Time{}
+	sc.run++
+	go sc.runSteps(sc.run)
+	gou.Infof("Started scenario %v", name)
+	return nil
+}
+
+//PauseScenario pauses a running scenario. Waits and assert timeouts stop counting while paused.
+func PauseScenario(name string) error {
+	return setScenarioState(name, SCENARIO_RUNNING, SCENARIO_PAUSED)
+}
+
+//AbortScenario stops a running or paused scenario. Rules it applied are left in place.
+func AbortScenario(name string) error {
+	err := setScenarioState(name, SCENARIO_RUNNING, SCENARIO_ABORTED)
+	if err != nil {
+		err = setScenarioState(name, SCENARIO_PAUSED, SCENARIO_ABORTED)
+	}
+	return err
+}
+
+func setScenarioState(name, from, to string) error {
+	sc, err := getScenario(name)
+	if err != nil {
+		return err
+	}
+	sc.sync.Lock()
+	defer sc.sync.Unlock()
+	if sc.State != from {
+		return fmt.Errorf("scenario %v is %v, not %v", name, sc.State, from)
+	}
+	sc.State = to
+	if to == SCENARIO_ABORTED {
+		sc.Finished = time.Now()
+	}
+	gou.Infof("Scenario %v %v at step %v", name, to, sc.Step)
+	return nil
+}
+
+//ScenarioStatus is a copy of a scenario and its progress.
+type ScenarioStatus struct {
+	Name     string
+	Session  string `json:",omitempty"`
+	Steps    []ScenarioStep
+	State    string
+	Step     int
+	Error    string `json:",omitempty"`
+	Started  time.Time
+	Finished time.Time
+}
+
+func (sc *Scenario) status() ScenarioStatus {
+	sc.sync.RLock()
+	defer sc.sync.RUnlock()
+	return ScenarioStatus{sc.Name, sc.Session, sc.Steps, sc.State, sc.Step, sc.Error, sc.Started, sc.Finished}
+}
+
+func (sc *Scenario) runSteps(run int) {
+	for i, step := range sc.Steps {
+		if !sc.await(run) {
+			return
+		}
+		sc.sync.Lock()
+		sc.Step = i
+		sc.sync.Unlock()
+
+		gou.Infof("Scenario %v step %v: %+v", sc.Name, i, step)
+		if err := sc.runStep(run, step); err != nil {
+			sc.finish(run, SCENARIO_FAILED, fmt.Sprintf("step %v: %v", i, err))
+			return
+		}
+	}
+	sc.finish(run, SCENARIO_COMPLETED, "")
+}
+
+func (sc *Scenario) finish(run int, state, err string) {
+	sc.sync.Lock()
+	defer sc.sync.Unlock()
+	if sc.run != run || sc.State != SCENARIO_RUNNING {
+		return
+	}
+	sc.State, sc.Error, sc.Finished = state, err, time.Now()
+	gou.Infof("Scenario %v %v. %v", sc.Name, state, err)
+}
+
+//await blocks while the scenario is paused and returns false if run was aborted.
+func (sc *Scenario) await(run int) bool {
+	for {
+		sc.sync.RLock()
+		state := sc.State
+		if sc.run != run {
+			state = SCENARIO_ABORTED
+		}
+		sc.sync.RUnlock()
+		switch state {
+		case SCENARIO_RUNNING:
+			return true
+		case SCENARIO_PAUSED:
+			time.Sleep(scenarioTick)
+		default:
+			return false
+		}
+	}
+}
+
+//sleep sleeps for d of running time and returns false if run was aborted.
+func (sc *Scenario) sleep(run int, d time.Duration) bool {
+	for d > 0 {
+		if !sc.await(run) {
+			return false
+		}
+		tick := scenarioTick
+		if d < tick {
+			tick = d
+		}
+		time.Sleep(tick)
+		d -= tick
+	}
+	return sc.await(run)
+}
+
+func (sc *Scenario) runStep(run int, step ScenarioStep) error {
+	s, err := GetSession(sc.Session)
+	if err != nil {
+		return err
+	}
+
+	switch step.Action {
+	case STEP_SET_LATENCY:
+		latency, _ := time.ParseDuration(step.Latency)
+		count := step.Count
+		if count == 0 {
+			count = -1
+		}
+		_, err = s.SetLatencyForHost(step.Host, step.Type, latency, count)
+	case STEP_CLEAR_LATENCY:
+		_, err = s.SetLatencyForHost(step.Host, step.Type, 0, -1)
+	case STEP_BLACKLIST_ADD, STEP_BLACKLIST_REMOVE:
+		_, err = s.SetBlacklistForHost(step.Host, step.Action == STEP_BLACKLIST_ADD)
+	case STEP_WHITELIST_ADD, STEP_WHITELIST_REMOVE:
+		_, err = s.SetWhitelistForHost(step.Host, step.Action == STEP_WHITELIST_ADD)
+	case STEP_WAIT:
+		d, _ := time.ParseDuration(step.Duration)
+		sc.sleep(run, d)
+	case STEP_ASSERT:
+		timeout := time.Duration(0)
+		if step.Timeout != "" {
+			timeout, _ = time.ParseDuration(step.Timeout)
+		}
+		for {
+			value := s.Counters()[step.Counter]
+			if compare(value, step.Op, step.Value) {
+				return nil
+			}
+			if timeout <= 0 {
+				return fmt.Errorf("assert failed: %v=%v, expected %v %v", step.Counter, value, step.Op, step.Value)
+			}
+			if !sc.sleep(run, scenarioTick) {
+				return nil
+			}
+			timeout -= scenarioTick
+		}
+	}
+	return err
+}
+
+func (step ScenarioStep) validate() error {
+	switch step.Action {
+	case STEP_SET_LATENCY:
+		if latency, err := time.ParseDuration(step.Latency); err != nil || latency <= 0 {
+			return fmt.Errorf("invalid latency %q", step.Latency)
+		}
+		fallthrough
+	case STEP_CLEAR_LATENCY:
+		switch step.Type {
+		case PER_REMOTE_WRITE, PER_REMOTE_READ, PER_REMOTE_CONNECT:
+		default:
+			return fmt.Errorf("unknown latency type %q", step.Type)
+		}
+		fallthrough
+	case STEP_BLACKLIST_ADD, STEP_BLACKLIST_REMOVE, STEP_WHITELIST_ADD, STEP_WHITELIST_REMOVE:
+		if step.Host == "" {
+			return fmt.Errorf("%v needs a host", step.Action)
+		}
+	case STEP_WAIT:
+		if _, err := time.ParseDuration(step.Duration); err != nil {
+			return fmt.Errorf("invalid duration %q", step.Duration)
+		}
+	case STEP_ASSERT:
+		if step.Counter == "" {
+			return fmt.Errorf("assert needs a counter")
+		}
+		if !validOps[step.Op] {
+			return fmt.Errorf("invalid op %q", step.Op)
+		}
+		if step.Timeout != "" {
+			if _, err := time.ParseDuration(step.Timeout); err != nil {
+				return fmt.Errorf("invalid timeout %q", step.Timeout)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown action %q", step.Action)
+	}
+	return nil
+}
+
+var validOps = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func compare(value float64, op string, expected float64) bool {
+	switch op {
+	case "==":
+		return value == expected
+	case "!=":
+		return value != expected
+	case "<":
+		return value < expected
+	case "<=":
+		return value <= expected
+	case ">":
+		return value > expected
+	case ">=":
+		return value >= expected
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func waitForScenario(name string, timeout time.Duration) ScenarioStatus {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, _ := GetScenario(name)
+		if status.State != SCENARIO_RUNNING || time.Now().After(deadline) {
+			return status
+		}
+		time.Sleep(50e6)
+	}
+}
+
+func TestScenarioRuns(t *testing.T) {
+	s, err := CreateSession("ci-6", "", []string{"127.0.0.1", "::1"}, "")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer DeleteSession("ci-6")
+
+	_, err = UploadScenario([]byte(`{"name": "slow-then-fast", "session": "ci-6", "steps": [
+		{"action": "set_latency", "host": "localhost", "type": "per_remote_connect", "latency": "300ms"},
+		{"action": "assert", "counter": "conns;Total;All", "op": ">=", "value": 1, "timeout": "5s"},
+		{"action": "clear_latency", "host": "localhost", "type": "per_remote_connect"},
+		{"action": "wait", "duration": "200ms"},
+		{"action": "assert", "counter": "conns;Total;All", "op": "==", "value": 1}
+	]}`))
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if err := StartScenario("slow-then-fast"); err != nil {
+		t.Fatal("got error", err)
+	}
+	time.Sleep(50e6)
+
+	duration, err := ClientRequestThroughProxy("localhost:9000", nil)
+	if err != nil {
+		t.Error("got error", err)
+	}
+	if duration < 300e6 {
+		t.Error("latency of scenario not applied", duration)
+	}
+
+	status := waitForScenario("slow-then-fast", 5e9)
+	if status.State != SCENARIO_COMPLETED || status.Step != 4 {
+		t.Error("expected scenario to complete", status)
+	}
+	if _, _, exists, _ := s.GetLatencyForHost("localhost", PER_REMOTE_CONNECT); exists {
+		t.Error("latency not cleared by scenario")
+	}
+}
+
+func TestScenarioFailsPausesAndAborts(t *testing.T) {
+	for _, invalid := range []string{
+		`{"steps": []}`,
+		`{"name": "x", "steps": [{"action": "explode"}]}`,
+		`{"name": "x", "steps": [{"action": "set_latency", "host": "localhost", "type": "per_remote_nothing", "latency": "1s"}]}`,
+		`{"name": "x", "steps": [{"action": "wait", "duration": "forever"}]}`,
+		`{"name": "x", "steps": [{"action": "assert", "counter": "a", "op": "=~"}]}`,
+	} {
+		if _, err := UploadScenario([]byte(invalid)); err == nil {
+			t.Error("Expected an err but didn't get one", invalid)
+		}
+	}
+
+	UploadScenario([]byte(`{"name": "failing", "steps": [{"action": "assert", "counter": "no such counter", "op": ">", "value": 0}]}`))
+	StartScenario("failing")
+	if status := waitForScenario("failing", 5e9); status.State != SCENARIO_FAILED || status.Error == "" {
+		t.Error("expected scenario to fail", status)
+	}
+
+	UploadScenario([]byte(`{"name": "long", "steps": [{"action": "wait", "duration": "400ms"}, {"action": "wait", "duration": "1h"}]}`))
+	StartScenario("long")
+	time.Sleep(200e6)
+	if err := PauseScenario("long"); err != nil {
+		t.Error("got error", err)
+	}
+	time.Sleep(400e6)
+	if status, _ := GetScenario("long"); status.State != SCENARIO_PAUSED || status.Step != 0 {
+		t.Error("expected scenario to be paused in the first step", status)
+	}
+	if _, err := UploadScenario([]byte(`{"name": "long"}`)); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+	StartScenario("long")
+	time.Sleep(400e6)
+	if status, _ := GetScenario("long"); status.State != SCENARIO_RUNNING || status.Step != 1 {
+		t.Error("expected scenario to resume into the second step", status)
+	}
+	if err := AbortScenario("long"); err != nil {
+		t.Error("got error", err)
+	}
+	if status, _ := GetScenario("long"); status.State != SCENARIO_ABORTED {
+		t.Error("expected scenario to be aborted", status)
+	}
+	if err := AbortScenario("long"); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+}
@@ -0,0 +1,292 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/araddon/gou"
+)
+
+//A Schedule applies a rule to Host for Duration at recurring times, either Every
+//interval starting at creation, or at the times matched by a Cron expression.
+type Schedule struct {
+	Name     string
+	Host     string
+	Type     string //PER_REMOTE_WRITE, PER_REMOTE_READ, PER_REMOTE_CONNECT or BLACKLIST
+	Latency  time.Duration
+	Count    int
+	Duration time.Duration
+	Every    time.Duration `json:",omitempty"`
+	Cron     string        `json:",omitempty"`
+	Next     time.Time
+
+	cron *cronExpr
+	stop chan struct{}
+}
+
+//AddSchedule validates sc and starts it in the session. The rule is applied at
+//the start of every window and expires at its end.
+func (s *Session) AddSchedule(sc Schedule) error {
+	switch sc.Type {
+	case PER_REMOTE_WRITE, PER_REMOTE_READ, PER_REMOTE_CONNECT:
+		if sc.Latency <= 0 {
+			return fmt.Errorf("schedule %v has no latency", sc.Name)
+		}
+	case BLACKLIST:
+	default:
+		return fmt.Errorf("unknown schedule type %v", sc.Type)
+	}
+	if sc.Name == "" || sc.Host == "" {
+		return fmt.Errorf("schedule needs a name and a host")
+	}
+	if sc.Duration <= 0 {
+		return fmt.Errorf("schedule %v has no duration", sc.Name)
+	}
+	if (sc.Every > 0) == (sc.Cron != "") {
+		return fmt.Errorf("schedule %v needs one of every or cron", sc.Name)
+	}
+	if sc.Every > 0 && sc.Duration >= sc.Every {
+		return fmt.Errorf("schedule %v lasts %v, which is not shorter than its interval %v", sc.Name, sc.Duration, sc.Every)
+	}
+	if sc.Cron != "" {
+		cron, err := parseCron(sc.Cron)
+		if err != nil {
+			return err
+		}
+		sc.cron = cron
+		if sc.Next = cron.next(time.Now()); sc.Next.IsZero() {
+			return fmt.Errorf("cron expression %q never matches", sc.Cron)
+		}
+		if interval := cron.minInterval(sc.Next); interval > 0 && sc.Duration >= interval {
+			return fmt.Errorf("schedule %v lasts %v, which is not shorter than its interval %v", sc.Name, sc.Duration, interval)
+		}
+	} else {
+		sc.Next = time.Now()
+	}
+	if sc.Count == 0 {
+		sc.Count = -1
+	}
+	sc.stop = make(chan struct{})
+
+	s.sync.Lock()
+	defer s.sync.Unlock()
+	if s.schedules == nil {
+		s.schedules = make(map[string]*Schedule)
+	}
+	if _, exists := s.schedules[sc.Name]; exists {
+		return conflictf("schedule %v already exists", sc.Name)
+	}
+	s.schedules[sc.Name] = &sc
+	go s.runSchedule(&sc, sc.Next)
+
+	gou.Infof("Added schedule %v. Host=%v; Type=%v; Every=%v; Cron=%v; Duration=%v; session=%v;", sc.Name, sc.Host, sc.Type, sc.Every, sc.Cron, sc.Duration, s.Name)
+	return nil
+}
+
+//RemoveSchedule stops a schedule. A window that is in progress runs to its end.
+func (s *Session) RemoveSchedule(name string) error {
+	s.sync.Lock()
+	sc, exists := s.schedules[name]
+	delete(s.schedules, name)
+	s.sync.Unlock()
+
+	if !exists {
+		return notFoundf("schedule %v does not exist", name)
+	}
+	close(sc.stop)
+	gou.Infof("Removed schedule %v. session=%v;", name, s.Name)
+	return nil
+}
+
+//GetSchedule returns a copy of the named schedule.
+func (s *Session) GetSchedule(name string) (Schedule, error) {
+	s.sync.RLock()
+	defer s.sync.RUnlock()
+	if sc, exists := s.schedules[name]; exists {
+		return *sc, nil
+	}
+	return Schedule{}, notFoundf("schedule %v does not exist in session %v", name, s.Name)
+}
+
+//Schedules returns copies of the session's schedules, sorted by name.
+func (s *Session) Schedules() []Schedule {
+	schedules := []Schedule{}
+	s.sync.RLock()
+	for _, sc := range s.schedules {
+		schedules = append(schedules, *sc)
+	}
+	s.sync.RUnlock()
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].Name < schedules[j].Name })
+	return schedules
+}
+
+//stopSchedules stops all schedules of a session that is being deleted.
+func (s *Session) stopSchedules() {
+	s.sync.Lock()
+	for name, sc := range s.schedules {
+		close(sc.stop)
+		delete(s.schedules, name)
+	}
+	s.sync.Unlock()
+}
+
+func (s *Session) runSchedule(sc *Schedule, next time.Time) {
+	for {
+		select {
+		case <-time.After(next.Sub(time.Now())):
+		case <-sc.stop:
+			return
+		}
+
+		s.activateSchedule(sc)
+
+		if sc.cron != nil {
+			if next = sc.cron.next(next); next.IsZero() {
+				return
+			}
+		} else {
+			next = next.Add(sc.Every)
+		}
+		s.sync.Lock()
+		sc.Next = next
+		s.sync.Unlock()
+	}
+}
+
+func (s *Session) activateSchedule(sc *Schedule) {
+	gou.Infof("Starting window of schedule %v for %v. session=%v;", sc.Name, sc.Duration, s.Name)
+	expires := time.Now().Add(sc.Duration)
+	if sc.Type == BLACKLIST {
+		rule := Rule{Type: BLACKLIST, Host: sc.Host, LatencyAndCountStruct: LatencyAndCountStruct{Count: -1, Expires: expires}}
+		if _, err := s.rules.Set(rule); err != nil {
+			gou.Error(err)
+		}
+		return
+	}
+
+	rule := LatencyAndCountStruct{Latency: sc.Latency, Count: sc.Count, Expires: expires}
+	if _, err := s.SetLatencyRuleForHost(sc.Host, sc.Type, rule); err != nil {
+		gou.Error(err)
+	}
+}
+
+//cronExpr is a standard 5 field cron expression: minute hour day-of-month month day-of-week.
+type cronExpr struct {
+	minute, hour, dom, month, dow map[int]bool
+	domStar, dowStar              bool
+}
+
+func parseCron(expr string) (*cronExpr, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields", expr)
+	}
+	var err error
+	c := &cronExpr{domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if c.dow[7] { //sunday is 0 or 7
+		c.dow[0] = true
+	}
+	return c, nil
+}
+
+//parseCronField parses a csv list of *, n, n-m, each optionally followed by /step.
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if splt := strings.SplitN(part, "/", 2); len(splt) == 2 {
+			var err error
+			if step, err = strconv.Atoi(splt[1]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in cron field %q", field)
+			}
+			part = splt[0]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			splt := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(splt[0]); err != nil {
+				return nil, fmt.Errorf("invalid cron field %q", field)
+			}
+			hi = lo
+			if len(splt) == 1 && step > 1 { //n/step runs from n to max
+				hi = max
+			}
+			if len(splt) == 2 {
+				if hi, err = strconv.Atoi(splt[1]); err != nil {
+					return nil, fmt.Errorf("invalid cron field %q", field)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("cron field %q out of range [%v,%v]", field, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+//next returns the first time after t that matches the expression.
+func (c *cronExpr) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		if c.minute[t.Minute()] && c.hour[t.Hour()] && c.month[int(t.Month())] && c.matchesDay(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+//minInterval returns the shortest time between the times the expression matches
+//within a year from t, or 0 if it matches once at most.
+func (c *cronExpr) minInterval(t time.Time) time.Duration {
+	interval := time.Duration(0)
+	limit := t.AddDate(1, 0, 0)
+	for prev := c.next(t); !prev.IsZero() && prev.Before(limit) && interval != time.Minute; {
+		next := c.next(prev)
+		if next.IsZero() {
+			break
+		}
+		if d := next.Sub(prev); interval == 0 || d < interval {
+			interval = d
+		}
+		prev = next
+	}
+	return interval
+}
+
+//matchesDay follows cron: if both day fields are restricted, either may match.
+func (c *cronExpr) matchesDay(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	if !c.domStar && !c.dowStar {
+		return dom || dow
+	}
+	return dom && dow
+}
@@ -0,0 +1,119 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2016, 3, 4, 10, 7, 30, 0, time.UTC) //a friday
+	cases := map[string]time.Time{
+		"* * * * *":       time.Date(2016, 3, 4, 10, 8, 0, 0, time.UTC),
+		"*/5 * * * *":     time.Date(2016, 3, 4, 10, 10, 0, 0, time.UTC),
+		"0 9-17 * * 1-5":  time.Date(2016, 3, 4, 11, 0, 0, 0, time.UTC),
+		"30 2 * * 0":      time.Date(2016, 3, 6, 2, 30, 0, 0, time.UTC),
+		"0 0 1 * *":       time.Date(2016, 4, 1, 0, 0, 0, 0, time.UTC),
+		"15,45 10 * * *":  time.Date(2016, 3, 4, 10, 15, 0, 0, time.UTC),
+		"0 12 31 12 *":    time.Date(2016, 12, 31, 12, 0, 0, 0, time.UTC),
+		"0 0 13 * 6":      time.Date(2016, 3, 5, 0, 0, 0, 0, time.UTC), //day of month or day of week
+		"5/20 10 * * *":   time.Date(2016, 3, 4, 10, 25, 0, 0, time.UTC),
+		"0 0 * * 7":       time.Date(2016, 3, 6, 0, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":      time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC).AddDate(4, 0, 0),
+		"59 23 31 12 5":   time.Date(2016, 12, 2, 23, 59, 0, 0, time.UTC),
+		"0-10/5 11 4 3 *": time.Date(2016, 3, 4, 11, 0, 0, 0, time.UTC),
+	}
+	for expr, expected := range cases {
+		cron, err := parseCron(expr)
+		if err != nil {
+			t.Error("got error", expr, err)
+			continue
+		}
+		if next := cron.next(from); !next.Equal(expected) {
+			t.Error("unexpected next time for", expr, next, expected)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Error("Expected an err but didn't get one", expr)
+		}
+	}
+}
+
+func TestScheduleWindows(t *testing.T) {
+	s, err := CreateSession("ci-5", "", nil, "")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer DeleteSession("ci-5")
+
+	invalid := []Schedule{
+		{Name: "no-interval", Host: "localhost", Type: PER_REMOTE_WRITE, Latency: 1e9, Duration: 1e9},
+		{Name: "too-long", Host: "localhost", Type: PER_REMOTE_WRITE, Latency: 1e9, Duration: 1e9, Every: 1e9},
+		{Name: "no-latency", Host: "localhost", Type: PER_REMOTE_WRITE, Duration: 1e9, Every: 2e9},
+		{Name: "bad-type", Host: "localhost", Type: "per_remote_nothing", Latency: 1e9, Duration: 1e9, Every: 2e9},
+		{Name: "never", Host: "localhost", Type: PER_REMOTE_WRITE, Latency: 1e9, Duration: 1e9, Cron: "0 0 31 2 *"},
+		{Name: "too-long-cron", Host: "localhost", Type: PER_REMOTE_WRITE, Latency: 1e9, Duration: 10 * time.Minute, Cron: "0,10,30 * * * *"},
+	}
+	for _, sc := range invalid {
+		if err := s.AddSchedule(sc); err == nil {
+			t.Error("Expected an err but didn't get one", sc.Name)
+		}
+	}
+
+	err = s.AddSchedule(Schedule{Name: "flaky", Host: "localhost", Type: PER_REMOTE_WRITE, Latency: 1e9, Duration: 200e6, Every: 400e6})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if schedules := s.Schedules(); len(schedules) != 1 || schedules[0].Name != "flaky" {
+		t.Error("expected one schedule", schedules)
+	}
+
+	for window := 0; window < 2; window++ {
+		time.Sleep(100e6)
+		if _, _, exists, _ := s.GetLatencyForHost("localhost", PER_REMOTE_WRITE); !exists {
+			t.Error("latency not set during window", window)
+		}
+		time.Sleep(200e6)
+		if _, _, exists, _ := s.GetLatencyForHost("localhost", PER_REMOTE_WRITE); exists {
+			t.Error("latency set outside of window", window)
+		}
+		time.Sleep(100e6)
+	}
+
+	if err := s.RemoveSchedule("flaky"); err != nil {
+		t.Error("got error", err)
+	}
+	time.Sleep(500e6)
+	if _, _, exists, _ := s.GetLatencyForHost("localhost", PER_REMOTE_WRITE); exists {
+		t.Error("latency set after the schedule was removed")
+	}
+}
+
+func TestScheduleBlacklistWindow(t *testing.T) {
+	s, err := CreateSession("ci-6", "", nil, "")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer DeleteSession("ci-6")
+
+	err = s.AddSchedule(Schedule{Name: "outage", Host: "localhost", Type: BLACKLIST, Duration: 200e6, Every: time.Hour})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer s.RemoveSchedule("outage")
+	time.Sleep(100e6)
+	if rules := s.ListRules(); len(rules) != 1 || rules[0].Type != BLACKLIST || rules[0].Expires.IsZero() {
+		t.Error("expected a blacklist rule that expires at the end of the window", rules)
+	}
+	time.Sleep(200e6)
+	if rules := s.ListRules(); len(rules) != 0 {
+		t.Error("blacklist set outside of window", rules)
+	}
+}
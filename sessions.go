@@ -0,0 +1,384 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/araddon/gou"
+	"github.com/tawawhite/go-socks5"
+)
+
+//A Session owns a set of fault rules and counters so that several test suites can share one
+//proxy without interfering with each other. Connections are routed to a session
+//by the listener they arrived on, the SOCKS5 username they authenticated with,
+//or their source address, in that order. Connections that match no session use
+//DefaultSession, which the package level functions operate on.
+type Session struct {
+	Name     string
+	Username string   `json:",omitempty"`
+	Sources  []string `json:",omitempty"` //ips or cidrs
+	Addr     string   `json:",omitempty"` //dedicated listener
+	Created  time.Time
+
+	rules        *RuleEngine
+	sync         sync.RWMutex
+	counters     map[string]float64
+	countersSync sync.RWMutex
+	schedules    map[string]*Schedule
+	conns        map[string]Connection
+	nets         []*net.IPNet
+	server       *server //of the dedicated listener
+	proxy        *Proxy  //nil for package level sessions
+}
+
+var (
+	DefaultSession = &Session{Name: "default", rules: NewRuleEngine("default")}
+	Sessions       = make(map[string]*Session)
+	sessionsSync   sync.RWMutex
+)
+
+//CreateSession registers a new, empty session. sources is a list of ips or cidrs.
+//If addr is set, a listener dedicated to the session is started on it.
+func CreateSession(name, username string, sources []string, addr string) (*Session, error) {
+	if name == "" || name == DefaultSession.Name {
+		return nil, fmt.Errorf("invalid session name %q", name)
+	}
+
+	nets, err := parseSources(sources)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{Name: name, Username: username, Sources: sources, Addr: addr, Created: time.Now(), rules: NewRuleEngine(name), counters: make(map[string]float64), nets: nets}
+
+	sessionsSync.Lock()
+	defer sessionsSync.Unlock()
+	if _, exists := Sessions[name]; exists {
+		return nil, conflictf("session %v already exists", name)
+	}
+	for _, other := range Sessions {
+		if username != "" && other.Username == username {
+			return nil, conflictf("username %v is already used by session %v", username, other.Name)
+		}
+	}
+
+	if addr != "" {
+		if s.server, s.Addr, err = listen(addr, s); err != nil {
+			return nil, err
+		}
+		go s.server.serve()
+	}
+
+	Sessions[name] = s
+	gou.Infof("Created session %v. Username=%v; Sources=%v; Addr=%v;", name, username, sources, s.Addr)
+	return s, nil
+}
+
+//parseSources parses a list of ips or cidrs.
+func parseSources(sources []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, source := range sources {
+		if !strings.Contains(source, "/") {
+			if ip := net.ParseIP(source); ip != nil && ip.To4() != nil {
+				source += "/32"
+			} else {
+				source += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+//DeleteSession removes a session together with all of its rules and schedules and
+//closes its dedicated listener, if any. Connections that are already established keep
+//their rules until they close.
+func DeleteSession(name string) error {
+	return deleteSession(name, false)
+}
+
+//deleteSession deletes the named session, only if it has a dedicated listener if
+//listener is set.
+func deleteSession(name string, listener bool) error {
+	sessionsSync.Lock()
+	s, exists := Sessions[name]
+	if listener && exists && s.server == nil {
+		exists = false
+	}
+	if exists {
+		delete(Sessions, name)
+	}
+	sessionsSync.Unlock()
+
+	if !exists && listener {
+		return notFoundf("listener %v does not exist", name)
+	}
+	if !exists {
+		return notFoundf("session %v does not exist", name)
+	}
+	s.close()
+	return nil
+}
+
+//close closes the dedicated listener and stops the schedules of a session that was
+//removed from Sessions.
+func (s *Session) close() {
+	if s.server != nil {
+		s.server.listener.Close()
+	}
+	s.stopSchedules()
+	gou.Infof("Deleted session %v", s.Name)
+}
+
+//GetSession returns the named session. An empty name returns DefaultSession.
+func GetSession(name string) (*Session, error) {
+	if name == "" || name == DefaultSession.Name {
+		return DefaultSession, nil
+	}
+	sessionsSync.RLock()
+	defer sessionsSync.RUnlock()
+	if s, exists := Sessions[name]; exists {
+		return s, nil
+	}
+	return nil, notFoundf("session %v does not exist", name)
+}
+
+//SessionNames lists the registered sessions, sorted.
+func SessionNames() []string {
+	names := []string{}
+	sessionsSync.RLock()
+	for name := range Sessions {
+		names = append(names, name)
+	}
+	sessionsSync.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+//sessionForConn picks the session for a new connection. bound is the session of
+//the listener the connection arrived on, nil for shared listeners.
+func sessionForConn(bound *Session, username string, addr net.Addr) *Session {
+	if bound != nil {
+		return bound
+	}
+
+	var ip net.IP
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	}
+
+	sessionsSync.RLock()
+	defer sessionsSync.RUnlock()
+	if username != "" {
+		for _, s := range Sessions {
+			if s.Username == username {
+				return s
+			}
+		}
+	}
+	if ip != nil {
+		for _, s := range Sessions {
+			for _, ipnet := range s.nets {
+				if ipnet.Contains(ip) {
+					return s
+				}
+			}
+		}
+	}
+	return DefaultSession
+}
+
+//SessionCounter counts towards the session's own counters and, for package level
+//sessions, the process wide Counters.
+type SessionCounter struct {
+	session *Session
+	key     string
+}
+
+func (c SessionCounter) Inc() { c.Add(1) }
+func (c SessionCounter) Dec() { c.Add(-1) }
+func (c SessionCounter) Add(v float64) {
+	if c.session.proxy == nil {
+		Counter(c.key).Add(v)
+	}
+	if c.session == DefaultSession {
+		return
+	}
+	c.session.countersSync.Lock()
+	c.session.counters[c.key] += v
+	c.session.countersSync.Unlock()
+}
+
+func (s *Session) Counter(key string) SessionCounter {
+	return SessionCounter{s, key}
+}
+
+//Counters returns a copy of the session's counters. The counters of DefaultSession
+//are the process wide Counters.
+func (s *Session) Counters() map[string]float64 {
+	counters := make(map[string]float64)
+	if s == DefaultSession {
+		CountersSync.RLock()
+		for key, v := range Counters {
+			counters[key] = v
+		}
+		CountersSync.RUnlock()
+		return counters
+	}
+	s.countersSync.RLock()
+	for key, v := range s.counters {
+		counters[key] = v
+	}
+	s.countersSync.RUnlock()
+	return counters
+}
+
+func (s *Session) ResetCounters() {
+	if s == DefaultSession {
+		CountersSync.Lock()
+		Counters = make(map[string]float64)
+		CountersSync.Unlock()
+		return
+	}
+	s.countersSync.Lock()
+	s.counters = make(map[string]float64)
+	s.countersSync.Unlock()
+}
+
+func (s *Session) SetLatencyForHost(host, _type string, latency time.Duration, count int) (string, error) {
+	return s.SetLatencyRuleForHost(host, _type, LatencyAndCountStruct{Latency: latency, Count: count})
+}
+
+//SetLatencyRuleForHost sets rule for host, replacing any rule of the same type.
+//A rule without latency and failure rate, or with a count of zero, is removed.
+func (s *Session) SetLatencyRuleForHost(host, _type string, rule LatencyAndCountStruct) (string, error) {
+	switch _type {
+	case PER_REMOTE_WRITE, PER_REMOTE_READ, PER_REMOTE_CONNECT:
+	default:
+		return "", fmt.Errorf("unknown latency type %v", _type)
+	}
+	if (rule.Latency <= 0 && rule.FailureRate == 0) || rule.Count == 0 {
+		return s.removeForHost(host, _type)
+	}
+
+	set, err := s.rules.Set(Rule{Type: _type, Host: host, LatencyAndCountStruct: rule})
+	if err != nil {
+		return "", err
+	}
+	gou.Infof("Set latency for %v (%v) to %v. count=%v; failure_rate=%v; ramp=%+v; start=%v; expires=%v; session=%v;", host, set.Match, set.Latency, set.Count, set.FailureRate, set.Ramp, set.Start, set.Expires, s.Name)
+	return set.Match, nil
+}
+
+func (s *Session) removeForHost(host, _type string) (string, error) {
+	rule := Rule{Type: _type, Host: host}
+	if err := rule.compile(); err != nil {
+		return "", err
+	}
+	s.rules.RemoveMatch(_type, rule.Match)
+	return rule.Match, nil
+}
+
+func (s *Session) GetLatencyForHost(host, _type string) (string, LatencyAndCountStruct, bool, error) {
+	rule := Rule{Type: _type, Host: host}
+	if err := rule.compile(); err != nil {
+		return "", LatencyAndCountStruct{Latency: time.Duration(0), Count: -1}, false, err
+	}
+	latencyAndCount, exists := LatencyAndCountStruct{Latency: time.Duration(0), Count: -1}, false
+	if set, found := s.rules.Lookup(_type, rule.Match); found {
+		latencyAndCount, exists = set.LatencyAndCountStruct, true
+	}
+
+	gou.Infof("Got latency for %v (%v) to %v. Exists=%v. session=%v;", host, rule.Match, latencyAndCount, exists, s.Name)
+	return rule.Match, latencyAndCount, exists, nil
+}
+
+func (s *Session) SetBlacklistForHost(host string, add bool) (string, error) {
+	return s.setHost(BLACKLIST, host, add)
+}
+
+func (s *Session) SetWhitelistForHost(host string, add bool) (string, error) {
+	return s.setHost(WHITELIST, host, add)
+}
+
+func (s *Session) setHost(_type, host string, add bool) (string, error) {
+	if !add {
+		return s.removeForHost(host, _type)
+	}
+	rule, err := s.rules.Set(Rule{Type: _type, Host: host, LatencyAndCountStruct: LatencyAndCountStruct{Count: -1}})
+	if err != nil {
+		return "", err
+	}
+	return rule.Match, nil
+}
+
+//middlewares returns the middleware of the session's connections.
+func (s *Session) middlewares() *middlewareRegistry {
+	if s.proxy != nil {
+		return &s.proxy.middlewares
+	}
+	return &middlewares
+}
+
+//applyLatency sleeps for the _type latency configured for remote_addr, if any,
+//and counts down rules that were set with a count. Returns true if the rule
+//failed the connection, or done was closed while sleeping, in which case the
+//caller must close the connection.
+func (s *Session) applyLatency(_type string, remote_addr *socks5.AddrSpec, rid string, done <-chan struct{}) bool {
+	rule, exists := s.rules.Apply(_type, addrIPs(remote_addr)...)
+	if !exists {
+		return false
+	}
+	sleep, failureRate := rule.At(time.Now())
+
+	if sleep > 0 {
+		select {
+		case <-time.After(sleep):
+		case <-done:
+			return true
+		}
+		switch _type {
+		case PER_REMOTE_CONNECT:
+			gou.Infof("Slept per connect: %v; Address=%v; rid=%v; session=%v;", sleep, *remote_addr, rid, s.Name)
+			s.Counter(fmt.Sprintf("latencyPerRequest;%v;Total", remote_addr.HostAndPort())).Add(sleep.Seconds())
+		case PER_REMOTE_READ:
+			gou.Infof("Slept per remote read: %v; Address=%v; rid=%v; session=%v;", sleep, *remote_addr, rid, s.Name)
+			s.Counter(fmt.Sprintf("latencyPerRemoteRead;%v;Total", remote_addr.HostAndPort())).Add(sleep.Seconds())
+		case PER_REMOTE_WRITE:
+			gou.Infof("Slept per remote write: %v; Address=%v; rid=%v; session=%v;", sleep, *remote_addr, rid, s.Name)
+			s.Counter(fmt.Sprintf("latencyPerRemoteWrite;%v;Total", remote_addr.HostAndPort())).Add(sleep.Seconds())
+		}
+	}
+
+	if failureRate > 0 && rand.Float64() < failureRate {
+		gou.Infof("Failing connection per %v. failure_rate=%v; Address=%v; rid=%v; session=%v;", _type, failureRate, *remote_addr, rid, s.Name)
+		s.Counter(fmt.Sprintf("failed;%v;Total", remote_addr.HostAndPort())).Inc()
+		return true
+	}
+	return false
+}
+
+//blacklisted reports whether a blacklist rule matches remote_addr.
+func (s *Session) blacklisted(remote_addr *socks5.AddrSpec) bool {
+	_, exists := s.rules.Apply(BLACKLIST, addrIPs(remote_addr)...)
+	return exists
+}
+
+//whitelisted reports whether a whitelist rule matches remote_addr.
+func (s *Session) whitelisted(remote_addr *socks5.AddrSpec) bool {
+	_, exists := s.rules.Apply(WHITELIST, addrIPs(remote_addr)...)
+	return exists
+}
@@ -0,0 +1,153 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func ClientRequestThroughProxy(proxyAddr string, auth *proxy.Auth) (time.Duration, error) {
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, proxy.Direct)
+	if err != nil {
+		return time.Duration(0), err
+	}
+
+	transport := &http.Transport{Dial: dialer.Dial, DisableKeepAlives: true}
+	client := http.Client{Transport: transport, Timeout: 10e9}
+	st := time.Now()
+	resp, err := client.Get("http://localhost:8111")
+	if err != nil {
+		return time.Now().Sub(st), err
+	}
+	defer resp.Body.Close()
+	_, err = ioutil.ReadAll(resp.Body)
+	return time.Now().Sub(st), err
+}
+
+func inDurationRange(duration time.Duration) bool {
+	return duration > time.Duration(low_duration_range) && duration < time.Duration(high_duration_range)
+}
+
+func TestSessionByUsername(t *testing.T) {
+	s, err := CreateSession("ci-1", "ci-1", nil, "")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer DeleteSession("ci-1")
+	s.SetLatencyForHost("localhost", PER_REMOTE_CONNECT, time.Duration(short_duration), -1)
+
+	duration, err := ClientRequestThroughProxy("localhost:9000", &proxy.Auth{User: "ci-1", Password: "ignored"})
+	if err != nil {
+		t.Error("got error", err)
+	}
+	if !inDurationRange(duration) {
+		t.Error("duration outside of expected range [1s,1.2s]", duration)
+	}
+
+	duration, err = ClientRequestThroughProxy("localhost:9000", nil)
+	if err != nil {
+		t.Error("got error", err)
+	}
+	if duration > time.Duration(low_duration_range) {
+		t.Error("default session got the latency of session ci-1", duration)
+	}
+}
+
+func TestSessionBySource(t *testing.T) {
+	s, err := CreateSession("ci-2", "", []string{"127.0.0.1", "::1"}, "")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	s.SetLatencyForHost("localhost", PER_REMOTE_CONNECT, time.Duration(short_duration), -1)
+
+	duration, err := ClientRequestThroughProxy("localhost:9000", nil)
+	if err != nil {
+		t.Error("got error", err)
+	}
+	if !inDurationRange(duration) {
+		t.Error("duration outside of expected range [1s,1.2s]", duration)
+	}
+
+	if err := DeleteSession("ci-2"); err != nil {
+		t.Error("got error", err)
+	}
+	duration, err = ClientRequestThroughProxy("localhost:9000", nil)
+	if err != nil {
+		t.Error("got error", err)
+	}
+	if duration > time.Duration(low_duration_range) {
+		t.Error("latency outlived its session", duration)
+	}
+}
+
+func TestSessionByListener(t *testing.T) {
+	s, err := CreateSession("ci-3", "", nil, "localhost:0")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	s.SetLatencyForHost("localhost", PER_REMOTE_CONNECT, time.Duration(short_duration), -1)
+
+	duration, err := ClientRequestThroughProxy(s.Addr, nil)
+	if err != nil {
+		t.Error("got error", err)
+	}
+	if !inDurationRange(duration) {
+		t.Error("duration outside of expected range [1s,1.2s]", duration)
+	}
+
+	if _, err := CreateSession("ci-3", "", nil, ""); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+
+	DeleteSession("ci-3")
+	if _, err = ClientRequestThroughProxy(s.Addr, nil); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+	if _, err := GetSession("ci-3"); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+}
+
+func TestLatencyExpires(t *testing.T) {
+	s, err := CreateSession("ci-4", "", []string{"127.0.0.1", "::1"}, "")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer DeleteSession("ci-4")
+
+	now := time.Now()
+	s.SetLatencyRuleForHost("localhost", PER_REMOTE_CONNECT, LatencyAndCountStruct{Latency: time.Duration(short_duration), Count: -1, Start: now.Add(5e9)})
+	duration, err := ClientRequestThroughProxy("localhost:9000", nil)
+	if err != nil {
+		t.Error("got error", err)
+	}
+	if duration > time.Duration(low_duration_range) {
+		t.Error("latency applied before its start", duration)
+	}
+
+	_, err = s.SetLatencyRuleForHost("localhost", PER_REMOTE_WRITE, LatencyAndCountStruct{Latency: time.Duration(short_duration), Count: -1, Start: now, Expires: now})
+	if err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+
+	s.SetLatencyRuleForHost("localhost", PER_REMOTE_CONNECT, LatencyAndCountStruct{Latency: time.Duration(short_duration), Count: -1, Expires: now.Add(300e6)})
+	_, rule, exists, _ := s.GetLatencyForHost("localhost", PER_REMOTE_CONNECT)
+	if !exists || rule.TTL() <= 0 || rule.TTL() > 300e6 {
+		t.Error("expected a ttl in (0,300ms]", rule.TTL(), exists)
+	}
+
+	time.Sleep(400e6)
+	_, _, exists, _ = s.GetLatencyForHost("localhost", PER_REMOTE_CONNECT)
+	if exists {
+		t.Error("latency didn't expire")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/araddon/gou"
+)
+
+//Shared listeners started by NewListenerForTcpCopyingProxy.
+var (
+	sharedServers     []*server
+	sharedServersSync sync.Mutex
+)
+
+//drain stops servers from accepting connections and waits up to timeout for
+//active() to reach zero, then closes the remaining connections. Returns the
+//number of connections that were still active.
+func drain(servers []*server, timeout time.Duration, active func() float64) float64 {
+	for _, srv := range servers {
+		srv.listener.Close()
+	}
+	deadline := time.Now().Add(timeout)
+	for active() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100e6)
+	}
+	remaining := active()
+	for _, srv := range servers {
+		srv.close()
+	}
+	return remaining
+}
+
+//Shutdown stops the shared listeners and the listeners of the package level
+//sessions from accepting connections, waits up to timeout for the active
+//connections (ACTIVE_CONNS) to be done, then closes the remaining ones.
+func Shutdown(timeout time.Duration) {
+	sharedServersSync.Lock()
+	servers := append([]*server{}, sharedServers...)
+	sharedServersSync.Unlock()
+	sessionsSync.RLock()
+	for _, s := range Sessions {
+		if s.server != nil {
+			servers = append(servers, s.server)
+		}
+	}
+	sessionsSync.RUnlock()
+
+	gou.Infof("Shutting down. Draining connections for up to %v; active=%v;", timeout, DefaultSession.Counters()[ACTIVE_CONNS])
+	remaining := drain(servers, timeout, func() float64 {
+		return DefaultSession.Counters()[ACTIVE_CONNS]
+	})
+	if remaining > 0 {
+		gou.Infof("Closed %v connections that were still active after %v", remaining, timeout)
+	}
+}
+
+//Shutdown stops the proxy from accepting connections, waits up to timeout for its
+//active connections to be done, then closes it.
+func (p *Proxy) Shutdown(timeout time.Duration) error {
+	p.sync.Lock()
+	srv := p.server
+	p.sync.Unlock()
+	if srv != nil {
+		drain([]*server{srv}, timeout, func() float64 {
+			return p.Counters()[ACTIVE_CONNS]
+		})
+	}
+	return p.Close()
+}
+
+//WriteCounters writes the counters of every package level session as json to
+//path, by session name. The counters of the default session are the process wide
+//Counters. The file is replaced atomically.
+func WriteCounters(path string) error {
+	counters := map[string]map[string]float64{DefaultSession.Name: DefaultSession.Counters()}
+	for _, name := range SessionNames() {
+		if s, err := GetSession(name); err == nil {
+			counters[name] = s.Counters()
+		}
+	}
+	data, err := json.MarshalIndent(counters, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
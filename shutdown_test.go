@@ -0,0 +1,91 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProxyShutdown(t *testing.T) {
+	p := NewProxy(ProxyOptions{Addr: "localhost:0"})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	addr := p.Addr()
+
+	//drained: finishes within the timeout
+	p.SetLatencyForHost("localhost", PER_REMOTE_CONNECT, 300*time.Millisecond, 1)
+	done := make(chan error)
+	go func() {
+		_, err := ClientRequestThroughProxy(addr, nil)
+		done <- err
+	}()
+	time.Sleep(100e6)
+	p.Shutdown(5 * time.Second)
+	if err := <-done; err != nil {
+		t.Error("expected the active connection to be drained, got", err)
+	}
+	if _, err := ClientRequestThroughProxy(addr, nil); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+
+	//force closed: still active after the timeout
+	p = NewProxy(ProxyOptions{Addr: "localhost:0"})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	p.SetLatencyForHost("localhost", PER_REMOTE_CONNECT, 10*time.Second, -1)
+	go func() {
+		_, err := ClientRequestThroughProxy(p.Addr(), nil)
+		done <- err
+	}()
+	time.Sleep(100e6)
+	st := time.Now()
+	p.Shutdown(200 * time.Millisecond)
+	if err := <-done; err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+	if time.Since(st) > time.Second {
+		t.Error("shutdown took too long", time.Since(st))
+	}
+}
+
+func TestWriteCounters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counters")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := CreateSession("counted", "", nil, "")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer DeleteSession("counted")
+	s.Counter(TOTAL_CONNS).Add(3)
+
+	path := filepath.Join(dir, "counters.json")
+	if err := WriteCounters(path); err != nil {
+		t.Fatal("got error", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	counters := map[string]map[string]float64{}
+	if err := json.Unmarshal(data, &counters); err != nil {
+		t.Fatal("got error", err)
+	}
+	if counters["counted"][TOTAL_CONNS] != 3 || counters["default"][TOTAL_CONNS] < 3 {
+		t.Error("unexpected counters", counters)
+	}
+}
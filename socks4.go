@@ -0,0 +1,90 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/tawawhite/go-socks5"
+)
+
+const (
+	socks4Version  = 0x04
+	socks4Granted  = 90
+	socks4Rejected = 91
+
+	socks4MaxField = 255 //of the user id and the host name
+)
+
+//readSocks4Request reads the request of a SOCKS4 or SOCKS4a client, after the
+//version byte. The user id picks the session like a SOCKS5 username. SOCKS4a
+//clients send an ip of 0.0.0.x followed by the host name, for the proxy to resolve.
+func readSocks4Request(conn net.Conn) (*request, error) {
+	header := make([]byte, 7) //command, port and ip
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	userid, err := readNullTerminated(conn)
+	if err != nil {
+		return nil, err
+	}
+	addr := &socks5.AddrSpec{IP: net.IP(header[3:7]), Port: int(binary.BigEndian.Uint16(header[1:3]))}
+	if ip := addr.IP; ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if addr.FQDN, err = readNullTerminated(conn); err != nil {
+			return nil, err
+		}
+		addr.IP = nil
+	}
+	return &request{
+		version:  socks4Version,
+		command:  header[0],
+		addr:     addr,
+		username: userid,
+		reply: func(code byte, bound net.Addr) error {
+			return writeSocks4Reply(conn, code, bound)
+		},
+	}, nil
+}
+
+//readNullTerminated reads a string terminated by a null byte.
+func readNullTerminated(r io.Reader) (string, error) {
+	field := []byte{}
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(field), nil
+		}
+		if len(field) == socks4MaxField {
+			return "", fmt.Errorf("socks4 field longer than %v bytes", socks4MaxField)
+		}
+		field = append(field, b[0])
+	}
+}
+
+//writeSocks4Reply writes a SOCKS4 reply, granted for REPLY_SUCCEEDED and rejected
+//for the other SOCKS5 reply codes, with the bound ipv4 address if any.
+func writeSocks4Reply(w io.Writer, code byte, bound net.Addr) error {
+	reply := make([]byte, 8)
+	reply[1] = socks4Rejected
+	if code == REPLY_SUCCEEDED {
+		reply[1] = socks4Granted
+	}
+	if a, ok := bound.(*net.TCPAddr); ok {
+		if ip4 := a.IP.To4(); ip4 != nil {
+			binary.BigEndian.PutUint16(reply[2:4], uint16(a.Port))
+			copy(reply[4:], ip4)
+		}
+	}
+	_, err := w.Write(reply)
+	return err
+}
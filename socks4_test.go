@@ -0,0 +1,94 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+//socks4Connect sends a SOCKS4 CONNECT, or a SOCKS4a one if host is set, and
+//returns the connection and the reply code.
+func socks4Connect(t *testing.T, proxy string, addr *net.TCPAddr, host string) (net.Conn, byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	request := []byte{socks4Version, commandConnect, byte(addr.Port >> 8), byte(addr.Port)}
+	if host == "" {
+		request = append(request, addr.IP.To4()...)
+	} else {
+		request = append(request, 0, 0, 0, 1)
+	}
+	request = append(append(request, "ci-4"...), 0)
+	if host != "" {
+		request = append(append(request, host...), 0)
+	}
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal("got error", err)
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal("got error", err)
+	}
+	return conn, reply[1]
+}
+
+func TestSocks4(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	addr := upstream.Addr().(*net.TCPAddr)
+
+	p := NewProxy(ProxyOptions{Name: "socks4", Addr: "localhost:0"})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	defer p.Close()
+
+	for _, host := range []string{"", "localhost"} {
+		conn, code := socks4Connect(t, p.Addr(), addr, host)
+		if code != socks4Granted {
+			t.Fatal("expected the request to be granted, got", code)
+		}
+		conn.Write([]byte("ping"))
+		echo := make([]byte, 4)
+		if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "ping" {
+			t.Error("unexpected echo", string(echo), err)
+		}
+		conn.Close()
+	}
+	if p.Counters()["conns;"+addr.String()+";Total"] != 1 || p.Counters()["conns;"+net.JoinHostPort("localhost", strconv.Itoa(addr.Port))+";Total"] != 1 {
+		t.Error("expected the connections to be counted", p.Counters())
+	}
+
+	p.SetAccessMode(AccessMode{Mode: MODE_BLACKLIST})
+	p.SetBlacklistForHost("127.0.0.1", true)
+	conn, code := socks4Connect(t, p.Addr(), addr, "")
+	conn.Close()
+	if code != socks4Rejected {
+		t.Error("expected the request to be rejected, got", code)
+	}
+}
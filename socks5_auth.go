@@ -0,0 +1,90 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	socks5Version    = 0x05
+	authNone         = 0x00
+	authUserPass     = 0x02
+	authNoAcceptable = 0xff
+	userPassVersion  = 0x01
+	userPassSuccess  = 0x00
+)
+
+//negotiateAuth performs the SOCKS5 method negotiation so the proxy can learn the
+//username of clients that authenticate with RFC 1929 username/password. Any
+//password is accepted; the username is only used to pick a session. The version
+//byte of the greeting was already read.
+func negotiateAuth(conn net.Conn) (string, error) {
+	count := make([]byte, 1)
+	if _, err := io.ReadFull(conn, count); err != nil {
+		return "", err
+	}
+	methods := make([]byte, count[0])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(authNoAcceptable)
+	for _, m := range methods {
+		if m == authUserPass {
+			method = authUserPass
+			break
+		}
+		if m == authNone {
+			method = authNone
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+
+	username := ""
+	switch method {
+	case authNoAcceptable:
+		return "", fmt.Errorf("no acceptable authentication method in %v", methods)
+	case authUserPass:
+		var err error
+		if username, err = readUserPass(conn); err != nil {
+			return "", err
+		}
+		if _, err := conn.Write([]byte{userPassVersion, userPassSuccess}); err != nil {
+			return "", err
+		}
+	}
+
+	return username, nil
+}
+
+//readUserPass reads an RFC 1929 username/password request and returns the username.
+func readUserPass(r io.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	if header[0] != userPassVersion {
+		return "", fmt.Errorf("unsupported username/password version %v", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(r, username); err != nil {
+		return "", err
+	}
+	passwordLen := make([]byte, 1)
+	if _, err := io.ReadFull(r, passwordLen); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, make([]byte, passwordLen[0])); err != nil {
+		return "", err
+	}
+	return string(username), nil
+}
@@ -0,0 +1,180 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/tawawhite/go-socks5"
+)
+
+//SOCKS5 reply codes, RFC 1928.
+const (
+	REPLY_SUCCEEDED             = 0x00
+	REPLY_GENERAL_FAILURE       = 0x01
+	REPLY_NOT_ALLOWED           = 0x02 //connection not allowed by ruleset
+	REPLY_NETWORK_UNREACHABLE   = 0x03
+	REPLY_HOST_UNREACHABLE      = 0x04
+	REPLY_CONNECTION_REFUSED    = 0x05
+	REPLY_TTL_EXPIRED           = 0x06
+	REPLY_COMMAND_NOT_SUPPORTED = 0x07
+	REPLY_ADDRESS_NOT_SUPPORTED = 0x08
+)
+
+const (
+	commandConnect      = 0x01
+	commandBind         = 0x02
+	commandUDPAssociate = 0x03
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+//DeniedReply is the reply code sent to clients of the package level sessions when
+//the access mode denies their request. A Proxy has its own option.
+var DeniedReply byte = REPLY_NOT_ALLOWED
+
+var errAddressType = errors.New("unsupported address type")
+
+//readSocks5Request negotiates the authentication method and reads the request of
+//a SOCKS5 client, after the version byte.
+func readSocks5Request(conn net.Conn) (*request, error) {
+	username, err := negotiateAuth(conn)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported socks version %v", header[0])
+	}
+	addr, err := readAddr(conn)
+	if errors.Is(err, errAddressType) {
+		writeReply(conn, REPLY_ADDRESS_NOT_SUPPORTED, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &request{
+		version:  socks5Version,
+		command:  header[1],
+		addr:     addr,
+		username: username,
+		reply: func(code byte, bound net.Addr) error {
+			return writeReply(conn, code, bound)
+		},
+	}, nil
+}
+
+//readAddr reads an address and port in the SOCKS5 format.
+func readAddr(r io.Reader) (*socks5.AddrSpec, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return nil, err
+	}
+	addr := &socks5.AddrSpec{}
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp[0] == atypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+		addr.IP = ip
+	case atypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return nil, err
+		}
+		fqdn := make([]byte, length[0])
+		if _, err := io.ReadFull(r, fqdn); err != nil {
+			return nil, err
+		}
+		addr.FQDN = string(fqdn)
+	default:
+		return nil, fmt.Errorf("%w %v", errAddressType, atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+	addr.Port = int(binary.BigEndian.Uint16(port))
+	return addr, nil
+}
+
+//writeReply writes a SOCKS5 reply with the bound address, 0.0.0.0:0 if nil.
+func writeReply(w io.Writer, code byte, bound net.Addr) error {
+	ip, port := net.IPv4zero, 0
+	switch a := bound.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	_, err := w.Write(appendAddr([]byte{socks5Version, code, 0}, ip, port))
+	return err
+}
+
+//appendAddr appends an ip address and port in the SOCKS5 format to b.
+func appendAddr(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, atypIPv4), ip4...)
+	} else {
+		b = append(append(b, atypIPv6), ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+//resolve sets the IP of addresses requested by domain name.
+func resolve(addr *socks5.AddrSpec) error {
+	if addr.IP != nil {
+		return nil
+	}
+	ip, err := socks5.ResolveToIpCaching(addr.FQDN)
+	if err != nil {
+		return err
+	}
+	addr.IP = ip
+	return nil
+}
+
+//dialReply returns the reply code for an error dialing the destination.
+func dialReply(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return REPLY_CONNECTION_REFUSED
+	case errors.Is(err, syscall.ENETUNREACH):
+		return REPLY_NETWORK_UNREACHABLE
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return REPLY_HOST_UNREACHABLE
+	case errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, os.ErrDeadlineExceeded):
+		return REPLY_TTL_EXPIRED
+	}
+	return REPLY_GENERAL_FAILURE
+}
+
+//deniedReply returns the reply code for requests the session's access mode denies.
+func (s *Session) deniedReply() byte {
+	if s.proxy == nil {
+		return DeniedReply
+	}
+	if s.proxy.options.DeniedReply == 0 {
+		return REPLY_NOT_ALLOWED
+	}
+	return s.proxy.options.DeniedReply
+}
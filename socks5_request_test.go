@@ -0,0 +1,82 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+//socks5Request negotiates no authentication and sends a request for the ipv4
+//address addr, and returns the reply code.
+func socks5Request(t *testing.T, proxy string, command byte, addr *net.TCPAddr) byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer conn.Close()
+	request := []byte{socks5Version, 1, authNone, socks5Version, command, 0, atypIPv4}
+	request = append(append(request, addr.IP.To4()...), byte(addr.Port>>8), byte(addr.Port))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal("got error", err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal("got error", err)
+	}
+	return reply[3]
+}
+
+func TestDeniedReply(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer upstream.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+	addr := upstream.Addr().(*net.TCPAddr)
+
+	p := NewProxy(ProxyOptions{Name: "denied", Addr: "localhost:0", Blacklist: true, DeniedReply: REPLY_HOST_UNREACHABLE})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	defer p.Close()
+	p.SetBlacklistForHost("127.0.0.1", true)
+
+	if code := socks5Request(t, p.Addr(), commandConnect, addr); code != REPLY_HOST_UNREACHABLE {
+		t.Error("expected the configured reply code, got", code)
+	}
+	if atomic.LoadInt32(&accepted) != 0 {
+		t.Error("expected the denied host not to be connected to")
+	}
+	if p.Counters()["closed;"+addr.String()+";Total"] != 1 {
+		t.Error("expected the connection to be counted as closed", p.Counters())
+	}
+
+	if code := socks5Request(t, p.Addr(), 0x09, addr); code != REPLY_COMMAND_NOT_SUPPORTED {
+		t.Error("expected command not supported, got", code)
+	}
+
+	p.SetBlacklistForHost("127.0.0.1", false)
+	if code := socks5Request(t, p.Addr(), commandConnect, addr); code != REPLY_SUCCEEDED {
+		t.Error("expected success, got", code)
+	}
+}
@@ -0,0 +1,217 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/araddon/gou"
+)
+
+//A SessionState is the rules of a session and what routes connections to it.
+type SessionState struct {
+	Name     string
+	Username string   `json:",omitempty"`
+	Sources  []string `json:",omitempty"`
+	Addr     string   `json:",omitempty"`
+	Rules    []Rule
+}
+
+//A State is the fault state of the package level sessions: whether the blacklist
+//and the whitelist are enabled and their precedence, and the rules of every session.
+type State struct {
+	Blacklist  bool
+	Whitelist  bool
+	Precedence string         `json:",omitempty"` //PRECEDENCE_DENY if empty
+	Sessions   []SessionState //DefaultSession first
+}
+
+//ExportState returns the current State. Rules that were counted down to zero are
+//left out.
+func ExportState() State {
+	sessionsSync.RLock()
+	defer sessionsSync.RUnlock()
+	accessSync.RLock()
+	state := State{Blacklist: Blacklist, Whitelist: Whitelist}
+	if Blacklist && Whitelist {
+		state.Precedence = Precedence
+	}
+	accessSync.RUnlock()
+	names := []string{}
+	for name := range Sessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sessions := []*Session{DefaultSession}
+	for _, name := range names {
+		sessions = append(sessions, Sessions[name])
+	}
+	for _, s := range sessions {
+		ss := SessionState{Name: s.Name, Rules: []Rule{}}
+		if s != DefaultSession {
+			ss.Username, ss.Sources, ss.Addr = s.Username, s.Sources, s.Addr
+		}
+		for _, rule := range s.ListRules() {
+			if rule.Count != 0 {
+				ss.Rules = append(ss.Rules, rule)
+			}
+		}
+		state.Sessions = append(state.Sessions, ss)
+	}
+	return state
+}
+
+//ImportState replaces the current State with state. Sessions that don't exist are
+//created, with a dedicated listener if they have an Addr, and sessions that aren't
+//in state are deleted. The Addr of existing sessions is left as is. Rules keep their
+//ID if set.
+//
+//Everything is validated, and the new listeners bound, before anything is
+//replaced, so an import that fails changes nothing. Sessions can't be looked up,
+//created or deleted during the import, so new connections and exports see either
+//the previous state or the imported one.
+func ImportState(state State) error {
+	sessionsSync.Lock()
+	defer sessionsSync.Unlock()
+
+	type imported struct {
+		state   SessionState
+		session *Session //nil if it has to be created
+		nets    []*net.IPNet
+		server  *server //of the dedicated listener, bound to the session once created
+		addr    string  //bound address of server
+		rules   []Rule
+	}
+	mode := accessMode(state.Blacklist, state.Whitelist, state.Precedence)
+	if _, _, _, err := mode.lists(); err != nil {
+		return err
+	}
+	sessions := []*imported{}
+	names, usernames := map[string]bool{}, map[string]string{}
+	var servers []*server
+	fail := func(format string, v ...interface{}) error {
+		for _, srv := range servers {
+			srv.listener.Close()
+		}
+		return fmt.Errorf(format, v...)
+	}
+
+	for _, ss := range state.Sessions {
+		if ss.Name == "" {
+			ss.Name = DefaultSession.Name
+		}
+		if names[ss.Name] {
+			return fail("session %v is imported twice", ss.Name)
+		}
+		names[ss.Name] = true
+		if ss.Username != "" {
+			if other, used := usernames[ss.Username]; used {
+				return fail("username %v is used by sessions %v and %v", ss.Username, other, ss.Name)
+			}
+			usernames[ss.Username] = ss.Name
+		}
+		i := &imported{state: ss}
+		sessions = append(sessions, i)
+
+		var err error
+		if i.nets, err = parseSources(ss.Sources); err != nil {
+			return fail("session %v: %v", ss.Name, err)
+		}
+		keys, ids := map[ruleKey]bool{}, map[string]bool{}
+		for _, rule := range ss.Rules {
+			if err := rule.validate(); err != nil {
+				return fail("session %v: %v rule for %v: %v", ss.Name, rule.Type, rule.Host, err)
+			}
+			if keys[rule.key()] {
+				return fail("session %v has two %v rules for %v", ss.Name, rule.Type, rule.Match)
+			}
+			keys[rule.key()] = true
+			if rule.ID != "" {
+				if ids[rule.ID] {
+					return fail("session %v has two rules with id %v", ss.Name, rule.ID)
+				}
+				ids[rule.ID] = true
+			}
+			i.rules = append(i.rules, rule)
+		}
+
+		if ss.Name == DefaultSession.Name {
+			i.session = DefaultSession
+		} else if s, exists := Sessions[ss.Name]; exists {
+			i.session = s
+		} else if ss.Addr != "" {
+			if i.server, i.addr, err = listen(ss.Addr, nil); err != nil {
+				return fail("session %v: %w", ss.Name, err)
+			}
+			servers = append(servers, i.server)
+		}
+	}
+
+	//nothing can fail from here on
+	SetAccessMode(mode)
+	for _, i := range sessions {
+		s := i.session
+		if s == nil {
+			s = &Session{Name: i.state.Name, Created: time.Now(), rules: NewRuleEngine(i.state.Name), counters: make(map[string]float64)}
+			Sessions[s.Name] = s
+			if i.server != nil {
+				i.server.session = s
+				s.server, s.Addr = i.server, i.addr
+				go s.server.serve()
+			}
+		}
+		if s != DefaultSession {
+			s.Username, s.Sources, s.nets = i.state.Username, i.state.Sources, i.nets
+		}
+		s.rules.replace(i.rules)
+	}
+	if !names[DefaultSession.Name] {
+		DefaultSession.rules.replace(nil)
+	}
+	for name, s := range Sessions {
+		if !names[name] {
+			delete(Sessions, name)
+			s.close()
+		}
+	}
+
+	gou.Infof("Imported state. mode=%v; precedence=%v; Sessions=%v;", mode.Mode, mode.Precedence, len(sessions))
+	return nil
+}
+
+//replace replaces the rules of e with rules, which must be valid and have distinct
+//types and matches. Rules keep their ID if set.
+func (e *RuleEngine) replace(rules []Rule) {
+	e.sync.Lock()
+	e.rules = nil
+	set := []Rule{}
+	for _, rule := range rules {
+		rule := rule
+		if rule.ID != "" {
+			for key, id := range e.ids {
+				if id == rule.ID {
+					delete(e.ids, key)
+				}
+			}
+			e.ids[rule.key()] = rule.ID
+		}
+		rule.ID = e.id(rule.key())
+		e.seq++
+		rule.seq = e.seq
+		e.rules = append(e.rules, &rule)
+		set = append(set, rule)
+	}
+	e.sort()
+	e.sync.Unlock()
+
+	for _, rule := range set {
+		e.expireAt(rule)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImportState(t *testing.T) {
+	defer func() { Blacklist = false }()
+	defer DefaultSession.rules.replace(nil)
+	s, err := CreateSession("exported", "exported", []string{"10.1.0.0/16"}, "")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer DeleteSession("exported")
+	rule, err := s.AddRule(Rule{Type: PER_REMOTE_WRITE, Host: "localhost", Priority: 5, LatencyAndCountStruct: LatencyAndCountStruct{Latency: time.Second, Count: 3}})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	SetLatencyForHost("127.0.0.2", PER_REMOTE_CONNECT, time.Second, -1)
+
+	state := ExportState()
+	if len(state.Sessions) != 2 || state.Sessions[0].Name != "default" || len(state.Sessions[0].Rules) != 1 || state.Sessions[1].Username != "exported" {
+		t.Fatal("unexpected state", state)
+	}
+
+	//a failed import changes nothing
+	invalid := state
+	invalid.Sessions = append([]SessionState{}, state.Sessions...)
+	invalid.Sessions = append(invalid.Sessions, SessionState{Name: "new", Username: "exported", Rules: []Rule{{Type: BLACKLIST, Host: "localhost", LatencyAndCountStruct: LatencyAndCountStruct{Count: -1}}}})
+	if err := ImportState(invalid); err == nil {
+		t.Error("Expected an err but didn't get one")
+	}
+	if _, err := GetSession("new"); err == nil {
+		t.Error("expected session new not to be created")
+	}
+
+	//replaces the rules, keeping their ids, and deletes sessions that aren't imported
+	DeleteSession("exported")
+	SetLatencyForHost("127.0.0.3", PER_REMOTE_CONNECT, time.Second, -1)
+	state.Blacklist = true
+	state.Sessions[0].Rules = append(state.Sessions[0].Rules, Rule{Type: BLACKLIST, Host: "127.0.0.4", LatencyAndCountStruct: LatencyAndCountStruct{Count: -1}})
+	if err := ImportState(state); err != nil {
+		t.Fatal("got error", err)
+	}
+	if rules := DefaultSession.ListRules(); len(rules) != 2 || rules[0].Match != "127.0.0.2" || rules[1].Type != BLACKLIST || !Blacklist {
+		t.Error("unexpected default rules", rules)
+	}
+	s, err = GetSession("exported")
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	if got, err := s.GetRule(rule.ID); err != nil || got.Count != 3 || got.Priority != 5 {
+		t.Error("expected the rule to keep its id, got", got, err)
+	}
+	if sessionForConn(nil, "exported", nil) != s {
+		t.Error("expected connections with username exported to use the imported session")
+	}
+
+	if err := ImportState(State{Sessions: []SessionState{{Name: "default"}}}); err != nil {
+		t.Fatal("got error", err)
+	}
+	if _, err := GetSession("exported"); err == nil {
+		t.Error("expected session exported to be deleted")
+	}
+}
+
+//importListener exports the state with a listener on addr, deletes it, and
+//imports the state again.
+func importListener(t *testing.T, name, addr string) *Session {
+	t.Helper()
+	if _, err := CreateListener(name, addr); err != nil {
+		t.Fatal("got error", err)
+	}
+	state := ExportState()
+	DeleteSession(name)
+	if err := ImportState(state); err != nil {
+		t.Fatal("got error", err)
+	}
+	s, err := GetSession(name)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	t.Cleanup(func() { DeleteSession(name) })
+	return s
+}
+
+func TestImportHTTPListener(t *testing.T) {
+	s := importListener(t, "imported-http", "http://127.0.0.1:0")
+	if !strings.HasPrefix(s.Addr, "http://127.0.0.1:") || s.server.protocol != PROTOCOL_HTTP || s.server.session != s {
+		t.Error("expected the listener to serve an HTTP proxy", s.Addr, s.server.protocol)
+	}
+}
+
+func TestImportForward(t *testing.T) {
+	s := importListener(t, "imported-forward", "127.0.0.1:0->db.internal:5432")
+	if !strings.HasSuffix(s.Addr, "->db.internal:5432") || s.server.protocol != PROTOCOL_FORWARD || s.server.forward.FQDN != "db.internal" || s.server.forward.Port != 5432 {
+		t.Error("expected the listener to forward to its target", s.Addr, s.server.protocol)
+	}
+}
+
+func TestImportStateAtOnce(t *testing.T) {
+	states := []State{
+		{Sessions: []SessionState{{Name: "a-1"}, {Name: "a-2"}}},
+		{Sessions: []SessionState{{Name: "b-1"}, {Name: "b-2"}}},
+	}
+	defer func() {
+		for _, name := range []string{"a-1", "a-2", "b-1", "b-2"} {
+			DeleteSession(name)
+		}
+	}()
+	if err := ImportState(states[1]); err != nil {
+		t.Fatal("got error", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if err := ImportState(states[i%2]); err != nil {
+				t.Error("got error", err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		state := ExportState()
+		if len(state.Sessions) != 3 || state.Sessions[1].Name[0] != state.Sessions[2].Name[0] {
+			t.Fatal("expected the sessions of one import", state.Sessions)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/araddon/gou"
+	"github.com/tawawhite/go-socks5"
+)
+
+//udpReorderHold is how long a datagram held back for reordering waits for the next
+//one before it is sent anyway.
+const udpReorderHold = 100 * time.Millisecond
+
+//UDPFaults are the datagram faults of PER_REMOTE_UDP rules, besides the delay of
+//their Latency and the drop rate of their FailureRate. Rates are probabilities per
+//datagram, and are scaled by the Ramp of the rule.
+type UDPFaults struct {
+	DuplicateRate float64 `json:",omitempty"` //sends the datagram twice
+	ReorderRate   float64 `json:",omitempty"` //holds the datagram back until after the next one
+	Truncate      int     `json:",omitempty"` //cuts the data of longer datagrams to this many bytes, 0 for none
+}
+
+func (f *UDPFaults) validate() error {
+	if f.DuplicateRate < 0 || f.DuplicateRate > 1 {
+		return fmt.Errorf("duplicate rate %v is not in [0,1]", f.DuplicateRate)
+	}
+	if f.ReorderRate < 0 || f.ReorderRate > 1 {
+		return fmt.Errorf("reorder rate %v is not in [0,1]", f.ReorderRate)
+	}
+	if f.Truncate < 0 {
+		return fmt.Errorf("truncate size %v is < 0", f.Truncate)
+	}
+	return nil
+}
+
+//A udpAssociation relays the datagrams of a UDP ASSOCIATE request between its
+//client and the remotes the client sends to. Datagrams from other addresses are
+//dropped.
+type udpAssociation struct {
+	conn     *net.UDPConn
+	session  *Session
+	rid      string
+	clientIP net.IP       //of the control connection
+	client   *net.UDPAddr //from the request, or else the source of the first datagram
+
+	sync    sync.Mutex
+	remotes map[string]*socks5.AddrSpec //by ip:port
+	held    map[Direction]*heldDatagram
+}
+
+//A heldDatagram is held back for reordering.
+type heldDatagram struct {
+	send func()
+}
+
+//associate serves a UDP ASSOCIATE request. The datagrams of the client are relayed
+//on a new UDP socket for as long as local, the control connection, stays open.
+func (srv *server) associate(local net.Conn, req *request, rid string) {
+	session := sessionForConn(srv.session, req.username, local.RemoteAddr())
+	bind := &net.UDPAddr{}
+	if tcp, ok := local.LocalAddr().(*net.TCPAddr); ok {
+		bind.IP = tcp.IP
+	}
+	conn, err := net.ListenUDP("udp", bind)
+	if err != nil {
+		gou.Error(err)
+		req.reply(REPLY_GENERAL_FAILURE, nil)
+		local.Close()
+		return
+	}
+	if !srv.track(conn, false) {
+		local.Close()
+		return
+	}
+	defer srv.untrack(conn)
+	if err := req.reply(REPLY_SUCCEEDED, conn.LocalAddr()); err != nil {
+		gou.Error(err)
+		local.Close()
+		conn.Close()
+		return
+	}
+	gou.Infof("New udp association. Relay=%v; Client=%v; rid=%v; session=%v;", conn.LocalAddr(), local.RemoteAddr(), rid, session.Name)
+
+	session.Counter(TOTAL_CONNS).Inc()
+	session.Counter(ACTIVE_CONNS).Inc()
+	defer session.Counter(ACTIVE_CONNS).Dec()
+
+	a := &udpAssociation{conn: conn, session: session, rid: rid, remotes: make(map[string]*socks5.AddrSpec), held: make(map[Direction]*heldDatagram)}
+	if tcp, ok := local.RemoteAddr().(*net.TCPAddr); ok {
+		a.clientIP = tcp.IP
+	}
+	if req.addr.IP != nil && !req.addr.IP.IsUnspecified() && req.addr.Port != 0 {
+		a.client = &net.UDPAddr{IP: req.addr.IP, Port: req.addr.Port}
+	}
+
+	//the association ends with its control connection
+	go func() {
+		io.Copy(ioutil.Discard, local)
+		conn.Close()
+	}()
+	a.relay()
+	local.Close()
+	gou.Infof("Closed udp association. rid=%v; session=%v;", rid, session.Name)
+}
+
+//relay reads datagrams until the socket is closed.
+func (a *udpAssociation) relay() {
+	data := make([]byte, 64*1024)
+	for {
+		n, from, err := a.conn.ReadFromUDP(data)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				gou.Error(err)
+			}
+			return
+		}
+		datagram := append([]byte{}, data[:n]...)
+		if a.fromClient(from) {
+			a.outbound(datagram)
+		} else if remote := a.remote(from); remote != nil {
+			a.inbound(remote, from, datagram)
+		}
+	}
+}
+
+func (a *udpAssociation) fromClient(from *net.UDPAddr) bool {
+	a.sync.Lock()
+	defer a.sync.Unlock()
+	if a.client != nil {
+		return a.client.IP.Equal(from.IP) && a.client.Port == from.Port
+	}
+	if a.clientIP != nil && !a.clientIP.Equal(from.IP) {
+		return false
+	}
+	a.client = from
+	return true
+}
+
+func (a *udpAssociation) remote(from *net.UDPAddr) *socks5.AddrSpec {
+	a.sync.Lock()
+	defer a.sync.Unlock()
+	return a.remotes[from.String()]
+}
+
+//outbound relays a datagram of the client, with its SOCKS5 UDP header, to its
+//destination. Fragmented datagrams aren't supported and are dropped.
+func (a *udpAssociation) outbound(datagram []byte) {
+	r := bytes.NewReader(datagram)
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+	if header[2] != 0 {
+		gou.Infof("Dropping fragmented datagram. frag=%v; rid=%v; session=%v;", header[2], a.rid, a.session.Name)
+		return
+	}
+	remote_addr, err := readAddr(r)
+	if err == nil {
+		err = resolve(remote_addr)
+	}
+	if err != nil {
+		gou.Error(err)
+		return
+	}
+	if allowed, reason := a.session.access(remote_addr); !allowed {
+		gou.Infof("Denying datagram %v. Address=%v; rid=%v; session=%v;", reason, *remote_addr, a.rid, a.session.Name)
+		a.session.Counter(fmt.Sprintf("denied;%v;Total", remote_addr.HostAndPort())).Inc()
+		return
+	}
+
+	to := &net.UDPAddr{IP: remote_addr.IP, Port: remote_addr.Port}
+	a.sync.Lock()
+	a.remotes[to.String()] = remote_addr
+	a.sync.Unlock()
+	a.deliver(OUTBOUND, remote_addr, to, nil, datagram[len(datagram)-r.Len():])
+}
+
+//inbound relays a datagram of a remote to the client, with a SOCKS5 UDP header.
+func (a *udpAssociation) inbound(remote_addr *socks5.AddrSpec, from *net.UDPAddr, data []byte) {
+	a.sync.Lock()
+	client := a.client
+	a.sync.Unlock()
+	a.deliver(INBOUND, remote_addr, client, appendAddr([]byte{0, 0, 0}, from.IP, from.Port), data)
+}
+
+//deliver applies the session's udp rule for remote_addr to a datagram, and sends
+//it, header then data, to to.
+func (a *udpAssociation) deliver(dir Direction, remote_addr *socks5.AddrSpec, to *net.UDPAddr, header, data []byte) {
+	host := remote_addr.HostAndPort()
+	copies, delay, reorder := 1, time.Duration(0), false
+	if rule, exists := a.session.rules.Apply(PER_REMOTE_UDP, addrIPs(remote_addr)...); exists {
+		now := time.Now()
+		var dropRate float64
+		delay, dropRate = rule.At(now)
+		faults := UDPFaults{}
+		if rule.UDP != nil {
+			intensity := rule.intensity(now)
+			faults = UDPFaults{rule.UDP.DuplicateRate * intensity, rule.UDP.ReorderRate * intensity, rule.UDP.Truncate}
+		}
+
+		if dropRate > 0 && rand.Float64() < dropRate {
+			gou.Debugf("Dropping datagram. Address=%v; dir=%v; rid=%v; session=%v;", host, dir, a.rid, a.session.Name)
+			a.session.Counter(fmt.Sprintf("dropped;%v;%v", host, dir)).Inc()
+			return
+		}
+		if faults.Truncate > 0 && len(data) > faults.Truncate {
+			data = data[:faults.Truncate]
+			a.session.Counter(fmt.Sprintf("truncated;%v;%v", host, dir)).Inc()
+		}
+		if faults.DuplicateRate > 0 && rand.Float64() < faults.DuplicateRate {
+			copies = 2
+			a.session.Counter(fmt.Sprintf("duplicated;%v;%v", host, dir)).Inc()
+		}
+		reorder = faults.ReorderRate > 0 && rand.Float64() < faults.ReorderRate
+	}
+
+	datagram := append(append([]byte{}, header...), data...)
+	send := func() {
+		for i := 0; i < copies; i++ {
+			if _, err := a.conn.WriteToUDP(datagram, to); err != nil {
+				return
+			}
+			a.session.Counter(fmt.Sprintf("datagrams;%v;%v", host, dir)).Inc()
+			a.session.Counter(fmt.Sprintf("bytes;%v;%v", host, dir)).Add(float64(len(data)))
+			if dir == OUTBOUND {
+				a.session.Counter(TOTAL_DATAGRAMS_OUT).Inc()
+				a.session.Counter(TOTAL_BYTES_OUT).Add(float64(len(data)))
+			} else {
+				a.session.Counter(TOTAL_DATAGRAMS_IN).Inc()
+				a.session.Counter(TOTAL_BYTES_IN).Add(float64(len(data)))
+			}
+		}
+	}
+	if reorder && a.hold(dir, send) {
+		a.session.Counter(fmt.Sprintf("reordered;%v;%v", host, dir)).Inc()
+		return
+	}
+
+	//a held datagram goes right after this one
+	held := a.release(dir, nil)
+	sendAll := func() {
+		send()
+		if held != nil {
+			held()
+		}
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, sendAll)
+		return
+	}
+	sendAll()
+}
+
+//hold holds send back until the next datagram in dir, or udpReorderHold, and
+//returns false if a datagram is already held.
+func (a *udpAssociation) hold(dir Direction, send func()) bool {
+	a.sync.Lock()
+	defer a.sync.Unlock()
+	if a.held[dir] != nil {
+		return false
+	}
+	h := &heldDatagram{send}
+	a.held[dir] = h
+	time.AfterFunc(udpReorderHold, func() {
+		if send := a.release(dir, h); send != nil {
+			send()
+		}
+	})
+	return true
+}
+
+//release returns the send of the datagram held in dir, if it is h or h is nil.
+func (a *udpAssociation) release(dir Direction, h *heldDatagram) func() {
+	a.sync.Lock()
+	defer a.sync.Unlock()
+	held := a.held[dir]
+	if held == nil || h != nil && held != h {
+		return nil
+	}
+	delete(a.held, dir)
+	return held.send
+}
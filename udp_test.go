@@ -0,0 +1,190 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Intuit Inc.
+*/
+
+package destructive_socks5_proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//udpAssociate sends a UDP ASSOCIATE request and returns the control connection and
+//the address of the relay.
+func udpAssociate(t *testing.T, proxy string) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+	control, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	request := []byte{socks5Version, 1, authNone, socks5Version, commandUDPAssociate, 0, atypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := control.Write(request); err != nil {
+		t.Fatal("got error", err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(control, reply); err != nil {
+		t.Fatal("got error", err)
+	}
+	if reply[3] != REPLY_SUCCEEDED {
+		t.Fatal("expected success, got", reply[3])
+	}
+	return control, &net.UDPAddr{IP: net.IP(reply[6:10]), Port: int(reply[10])<<8 | int(reply[11])}
+}
+
+//udpEcho serves a UDP echo server until the test is done.
+func udpEcho(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		data := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFromUDP(data)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(data[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+//receive returns the data of the datagrams the client receives within timeout.
+func receive(client *net.UDPConn, timeout time.Duration) []string {
+	received := []string{}
+	data := make([]byte, 1024)
+	client.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, err := client.Read(data)
+		if err != nil {
+			return received
+		}
+		received = append(received, string(data[10:n])) //after the ipv4 header
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo := udpEcho(t)
+	p := NewProxy(ProxyOptions{Name: "udp", Addr: "127.0.0.1:0"})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	defer p.Close()
+	control, relay := udpAssociate(t, p.Addr())
+	defer control.Close()
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer client.Close()
+	header := appendAddr([]byte{0, 0, 0}, echo.IP, echo.Port)
+	send := func(data string) {
+		client.Write(append(append([]byte{}, header...), data...))
+	}
+
+	send("ping")
+	if received := receive(client, 200*time.Millisecond); len(received) != 1 || received[0] != "ping" {
+		t.Error("unexpected echo", received)
+	}
+	if p.Counters()["datagrams;"+echo.String()+";Out"] != 1 || p.Counters()[TOTAL_DATAGRAMS_IN] != 1 {
+		t.Error("expected the datagrams to be counted", p.Counters())
+	}
+
+	//truncated, then duplicated both ways
+	rule, err := p.AddRule(Rule{Type: PER_REMOTE_UDP, Host: "127.0.0.1", LatencyAndCountStruct: LatencyAndCountStruct{Count: -1}, UDP: &UDPFaults{Truncate: 2}})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	send("ping")
+	if received := receive(client, 200*time.Millisecond); len(received) != 1 || received[0] != "pi" {
+		t.Error("expected a truncated echo, got", received)
+	}
+	rule.UDP = &UDPFaults{DuplicateRate: 1}
+	if _, err := p.UpdateRule(rule.ID, rule); err != nil {
+		t.Fatal("got error", err)
+	}
+	send("ping")
+	if received := receive(client, 200*time.Millisecond); len(received) != 4 {
+		t.Error("expected 4 echoes, got", received)
+	}
+
+	//dropped
+	rule.UDP, rule.FailureRate = nil, 1
+	if _, err := p.UpdateRule(rule.ID, rule); err != nil {
+		t.Fatal("got error", err)
+	}
+	send("ping")
+	if received := receive(client, 200*time.Millisecond); len(received) != 0 {
+		t.Error("expected the datagram to be dropped, got", received)
+	}
+	if p.Counters()["dropped;"+echo.String()+";Out"] != 1 {
+		t.Error("expected the datagram to be counted as dropped", p.Counters())
+	}
+
+	//delayed
+	rule.FailureRate, rule.Latency = 0, 300*time.Millisecond
+	if _, err := p.UpdateRule(rule.ID, rule); err != nil {
+		t.Fatal("got error", err)
+	}
+	send("ping")
+	if received := receive(client, 400*time.Millisecond); len(received) != 0 {
+		t.Error("expected the echo to be delayed, got", received)
+	}
+	if received := receive(client, 400*time.Millisecond); len(received) != 1 {
+		t.Error("expected the delayed echo, got", received)
+	}
+}
+
+func TestUDPReorder(t *testing.T) {
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer sink.Close()
+	p := NewProxy(ProxyOptions{Name: "reorder", Addr: "127.0.0.1:0"})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal("got error", err)
+	}
+	defer p.Close()
+	p.AddRule(Rule{Type: PER_REMOTE_UDP, Host: "127.0.0.1", LatencyAndCountStruct: LatencyAndCountStruct{Count: -1}, UDP: &UDPFaults{ReorderRate: 1}})
+
+	control, relay := udpAssociate(t, p.Addr())
+	defer control.Close()
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal("got error", err)
+	}
+	defer client.Close()
+	addr := sink.LocalAddr().(*net.UDPAddr)
+	for _, data := range []string{"1", "2"} {
+		client.Write(append(appendAddr([]byte{0, 0, 0}, addr.IP, addr.Port), data...))
+	}
+
+	received := ""
+	data := make([]byte, 16)
+	sink.SetReadDeadline(time.Now().Add(time.Second))
+	for len(received) < 2 {
+		n, _, err := sink.ReadFromUDP(data)
+		if err != nil {
+			break
+		}
+		received += string(data[:n])
+	}
+	if received != "21" {
+		t.Error("expected the datagrams to be reordered, got", received)
+	}
+
+	//the association ends with the control connection
+	control.Close()
+	time.Sleep(100 * time.Millisecond)
+	if p.Counters()[ACTIVE_CONNS] != 0 {
+		t.Error("expected no active association", p.Counters())
+	}
+}